@@ -0,0 +1,195 @@
+package httpmod
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// akamaiPseudoHeaders maps the letters of an Akamai fingerprint to the
+// pseudo headers they stand for.
+var akamaiPseudoHeaders = map[string]string{
+	"m": ":method",
+	"a": ":authority",
+	"s": ":scheme",
+	"p": ":path",
+}
+
+// ParseAkamai returns the H2Settings described by the Akamai HTTP/2
+// fingerprint akamai, e.g. "1:65536;3:1000;4:6291456|15663105|0|m,a,s,p".
+// Its parts are the SETTINGS in the order they are sent, the increment of
+// the connection WINDOW_UPDATE, the PRIORITY frames as
+// "stream:exclusive:dependency:weight" separated by commas or "0" for none,
+// and the pseudo header order.
+func ParseAkamai(akamai string) (*H2Settings, error) {
+	parts := strings.Split(akamai, "|")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid Akamai fingerprint %q: expected 4 parts, got %d", akamai, len(parts))
+	}
+
+	settings := &H2Settings{
+		InitialWindowSize: 65535,
+		Settings:          []http2.Setting{},
+	}
+
+	if parts[0] != "" {
+		for _, s := range strings.Split(parts[0], ";") {
+			kv := strings.SplitN(s, ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid Akamai setting %q", s)
+			}
+			id, err := strconv.ParseUint(kv[0], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Akamai setting %q", s)
+			}
+			val, err := strconv.ParseUint(kv[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Akamai setting %q", s)
+			}
+			setting := http2.Setting{ID: http2.SettingID(id), Val: uint32(val)}
+			if err := setting.Valid(); err != nil {
+				return nil, fmt.Errorf("invalid Akamai setting %q: %v", s, err)
+			}
+			settings.Settings = append(settings.Settings, setting)
+		}
+	}
+	settings.MaxConcurrentStreams = settings.settingValue(http2.SettingMaxConcurrentStreams, 1000)
+
+	// "00" is used by some tools for a missing WINDOW_UPDATE
+	connFlow, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || connFlow > math.MaxInt32-uint64(settings.InitialWindowSize) {
+		return nil, fmt.Errorf("invalid Akamai window update %q", parts[1])
+	}
+	settings.ConnFlow = uint32(connFlow)
+
+	if parts[2] != "0" {
+		for _, s := range strings.Split(parts[2], ",") {
+			frame, err := parseAkamaiPriority(s)
+			if err != nil {
+				return nil, err
+			}
+			settings.PriorityFrames = append(settings.PriorityFrames, frame)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, letter := range strings.Split(parts[3], ",") {
+		name, ok := akamaiPseudoHeaders[letter]
+		if !ok || seen[name] {
+			return nil, fmt.Errorf("invalid Akamai pseudo header order %q", parts[3])
+		}
+		seen[name] = true
+		settings.PseudoHeaderOrder = append(settings.PseudoHeaderOrder, name)
+	}
+
+	return settings, nil
+}
+
+// parseAkamaiPriority parses a PRIORITY frame written as
+// "stream:exclusive:dependency:weight", with the weight from 1 to 256.
+func parseAkamaiPriority(s string) (PriorityFrame, error) {
+	var frame PriorityFrame
+	fields := strings.Split(s, ":")
+	if len(fields) != 4 {
+		return frame, fmt.Errorf("invalid Akamai priority %q", s)
+	}
+
+	streamID, err := strconv.ParseUint(fields[0], 10, 31)
+	if err != nil || streamID == 0 {
+		return frame, fmt.Errorf("invalid Akamai priority %q", s)
+	}
+	dep, err := strconv.ParseUint(fields[2], 10, 31)
+	if err != nil || dep == streamID {
+		return frame, fmt.Errorf("invalid Akamai priority %q", s)
+	}
+	weight, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil || weight < 1 || weight > 256 {
+		return frame, fmt.Errorf("invalid Akamai priority %q", s)
+	}
+
+	frame.StreamID = uint32(streamID)
+	frame.StreamDep = uint32(dep)
+	frame.Weight = uint8(weight - 1)
+	switch fields[1] {
+	case "0":
+	case "1":
+		frame.Exclusive = true
+	default:
+		return frame, fmt.Errorf("invalid Akamai priority %q", s)
+	}
+	return frame, nil
+}
+
+// AkamaiFingerprint returns the Akamai HTTP/2 fingerprint of clientFrames,
+// the bytes a client writes when it opens a connection: the preface and the
+// frames following it. The pseudo header order is taken from the first
+// HEADERS frame and left empty without one.
+func AkamaiFingerprint(clientFrames []byte) (string, error) {
+	if !bytes.HasPrefix(clientFrames, clientPreface) {
+		return "", errors.New("missing HTTP/2 client preface")
+	}
+	fr := http2.NewFramer(nil, bytes.NewReader(clientFrames[len(clientPreface):]))
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	var settings, priorities, pseudoHeaders []string
+	windowUpdate := "00"
+	for {
+		f, err := fr.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+			f.ForeachSetting(func(s http2.Setting) error {
+				settings = append(settings, fmt.Sprintf("%d:%d", s.ID, s.Val))
+				return nil
+			})
+		case *http2.WindowUpdateFrame:
+			if f.StreamID == 0 && windowUpdate == "00" {
+				windowUpdate = strconv.FormatUint(uint64(f.Increment), 10)
+			}
+		case *http2.PriorityFrame:
+			priorities = append(priorities, formatAkamaiPriority(f.StreamID, f.PriorityParam))
+		case *http2.MetaHeadersFrame:
+			for _, field := range f.PseudoFields() {
+				pseudoHeaders = append(pseudoHeaders, field.Name[1:2])
+			}
+		}
+		if pseudoHeaders != nil {
+			break
+		}
+	}
+
+	priority := "0"
+	if priorities != nil {
+		priority = strings.Join(priorities, ",")
+	}
+	return strings.Join([]string{
+		strings.Join(settings, ";"),
+		windowUpdate,
+		priority,
+		strings.Join(pseudoHeaders, ","),
+	}, "|"), nil
+}
+
+func formatAkamaiPriority(streamID uint32, param http2.PriorityParam) string {
+	exclusive := 0
+	if param.Exclusive {
+		exclusive = 1
+	}
+	return fmt.Sprintf("%d:%d:%d:%d", streamID, exclusive, param.StreamDep, int(param.Weight)+1)
+}
@@ -0,0 +1,139 @@
+package httpmod
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestParseAkamai(t *testing.T) {
+	tests := []struct {
+		akamai string
+		want   *H2Settings
+	}{
+		{
+			akamai: "1:65536;3:1000;4:6291456;6:262144|15663105|0|m,a,s,p",
+			want: &H2Settings{
+				ConnFlow:             15663105,
+				InitialWindowSize:    65535,
+				MaxConcurrentStreams: 1000,
+				Settings: []http2.Setting{
+					{ID: http2.SettingHeaderTableSize, Val: 65536},
+					{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
+					{ID: http2.SettingInitialWindowSize, Val: 6291456},
+					{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+				},
+				PseudoHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+			},
+		},
+		{
+			akamai: "1:65536;4:131072;5:16384|12517377|3:0:0:201,5:0:0:101,7:0:0:1,9:0:7:1,11:0:3:1,13:0:0:241|m,p,a,s",
+			want: &H2Settings{
+				ConnFlow:             12517377,
+				InitialWindowSize:    65535,
+				MaxConcurrentStreams: 1000,
+				Settings: []http2.Setting{
+					{ID: http2.SettingHeaderTableSize, Val: 65536},
+					{ID: http2.SettingInitialWindowSize, Val: 131072},
+					{ID: http2.SettingMaxFrameSize, Val: 16384},
+				},
+				PriorityFrames: []PriorityFrame{
+					{StreamID: 3, PriorityParam: http2.PriorityParam{Weight: 200}},
+					{StreamID: 5, PriorityParam: http2.PriorityParam{Weight: 100}},
+					{StreamID: 7, PriorityParam: http2.PriorityParam{Weight: 0}},
+					{StreamID: 9, PriorityParam: http2.PriorityParam{StreamDep: 7, Weight: 0}},
+					{StreamID: 11, PriorityParam: http2.PriorityParam{StreamDep: 3, Weight: 0}},
+					{StreamID: 13, PriorityParam: http2.PriorityParam{Weight: 240}},
+				},
+				PseudoHeaderOrder: []string{":method", ":path", ":authority", ":scheme"},
+			},
+		},
+		{
+			// GREASE settings are kept, "00" is no WINDOW_UPDATE
+			akamai: "2:0;4:4194304;3:100;2570:0|00|3:1:0:256|m,s,p,a",
+			want: &H2Settings{
+				InitialWindowSize:    65535,
+				MaxConcurrentStreams: 100,
+				Settings: []http2.Setting{
+					{ID: http2.SettingEnablePush, Val: 0},
+					{ID: http2.SettingInitialWindowSize, Val: 4194304},
+					{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+					{ID: 2570, Val: 0},
+				},
+				PriorityFrames: []PriorityFrame{
+					{StreamID: 3, PriorityParam: http2.PriorityParam{Exclusive: true, Weight: 255}},
+				},
+				PseudoHeaderOrder: []string{":method", ":scheme", ":path", ":authority"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ParseAkamai(test.akamai)
+		if err != nil {
+			t.Errorf("ParseAkamai(%q): %v", test.akamai, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseAkamai(%q) = %+v, want %+v", test.akamai, got, test.want)
+		}
+	}
+}
+
+func TestParseAkamaiErrors(t *testing.T) {
+	tests := []struct {
+		akamai string
+		want   string
+	}{
+		{"1:65536|15663105|m,a,s,p", "expected 4 parts"},
+		{"1:65536|15663105|0|m,a,s,p|x", "expected 4 parts"},
+		{"1=65536|15663105|0|m,a,s,p", "invalid Akamai setting"},
+		{"70000:1|15663105|0|m,a,s,p", "invalid Akamai setting"},
+		{"2:2|15663105|0|m,a,s,p", "invalid Akamai setting"},
+		{"4:2147483648|15663105|0|m,a,s,p", "invalid Akamai setting"},
+		{"1:65536|x|0|m,a,s,p", "invalid Akamai window update"},
+		{"1:65536|2147483647|0|m,a,s,p", "invalid Akamai window update"},
+		{"1:65536|15663105|3:0:0:0|m,a,s,p", "invalid Akamai priority"},
+		{"1:65536|15663105|3:0:0:257|m,a,s,p", "invalid Akamai priority"},
+		{"1:65536|15663105|3:2:0:201|m,a,s,p", "invalid Akamai priority"},
+		{"1:65536|15663105|3:0:3:201|m,a,s,p", "invalid Akamai priority"},
+		{"1:65536|15663105|0:0:0:201|m,a,s,p", "invalid Akamai priority"},
+		{"1:65536|15663105|3:0:201|m,a,s,p", "invalid Akamai priority"},
+		{"1:65536|15663105|0|m,a,x,p", "invalid Akamai pseudo header order"},
+		{"1:65536|15663105|0|m,a,m,p", "invalid Akamai pseudo header order"},
+		{"1:65536|15663105|0|", "invalid Akamai pseudo header order"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseAkamai(test.akamai)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ParseAkamai(%q) = %v, want an error containing %q", test.akamai, err, test.want)
+		}
+	}
+}
+
+func TestParseAkamaiRoundTrip(t *testing.T) {
+	for _, akamai := range []string{
+		"1:65536;3:1000;4:6291456;6:262144|15663105|0|m,a,s,p",
+		"1:65536;4:131072;5:16384|12517377|3:0:0:201,5:0:0:101,7:0:0:1,9:0:7:1,11:0:3:1,13:0:0:241|m,p,a,s",
+		"4:4194304;3:100|10485760|0|m,s,p,a",
+	} {
+		settings, err := ParseAkamai(akamai)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, err := marshalClientPreface("example.com", settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := AkamaiFingerprint(frames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != akamai {
+			t.Errorf("settings parsed from %q send %q", akamai, got)
+		}
+	}
+}
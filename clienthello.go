@@ -0,0 +1,142 @@
+package httpmod
+
+import (
+	"errors"
+	"fmt"
+)
+
+// clientHello holds the parts of a ClientHello that fingerprints are made
+// of, GREASE values included.
+type clientHello struct {
+	version      uint16
+	cipherSuites []uint16
+	extensions   []uint16
+
+	serverName          bool
+	curves              []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	alpnProtocols       []string
+	supportedVersions   []uint16
+}
+
+var errShortClientHello = errors.New("truncated ClientHello")
+
+// helloReader reads the fields of a ClientHello. Readers for nested vectors
+// share the error of their parent, the first one sticks.
+type helloReader struct {
+	b   []byte
+	err *error
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if *r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		*r.err = errShortClientHello
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *helloReader) uint8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *helloReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func (r *helloReader) uint24() int {
+	b := r.bytes(3)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// vector returns a reader for the next vector with a length prefix of n
+// bytes.
+func (r *helloReader) vector(n int) *helloReader {
+	length := int(r.uint8())
+	if n == 2 {
+		length = length<<8 | int(r.uint8())
+	}
+	return &helloReader{b: r.bytes(length), err: r.err}
+}
+
+func (r *helloReader) more() bool {
+	return len(r.b) > 0 && *r.err == nil
+}
+
+func (r *helloReader) uint16s() []uint16 {
+	var values []uint16
+	for r.more() {
+		values = append(values, r.uint16())
+	}
+	return values
+}
+
+// parseClientHello parses a ClientHello handshake message, with or without
+// the TLS record header in front of it.
+func parseClientHello(data []byte) (*clientHello, error) {
+	var err error
+	r := &helloReader{b: data, err: &err}
+	if len(data) > 0 && data[0] == 0x16 {
+		// record header: type, version, length
+		r.bytes(5)
+	}
+	if r.uint8() != 1 {
+		return nil, fmt.Errorf("not a ClientHello")
+	}
+	r = &helloReader{b: r.bytes(r.uint24()), err: &err}
+
+	hello := &clientHello{version: r.uint16()}
+	r.bytes(32) // random
+	r.vector(1) // session id
+	hello.cipherSuites = r.vector(2).uint16s()
+	r.vector(1) // compression methods
+
+	extensions := r.vector(2)
+	for extensions.more() {
+		id := extensions.uint16()
+		body := extensions.vector(2)
+		hello.extensions = append(hello.extensions, id)
+
+		switch id {
+		case 0: // server_name
+			hello.serverName = true
+		case 10: // supported_groups
+			hello.curves = body.vector(2).uint16s()
+		case 11: // ec_point_formats
+			formats := body.vector(1)
+			hello.pointFormats = formats.bytes(len(formats.b))
+		case 13: // signature_algorithms
+			hello.signatureAlgorithms = body.vector(2).uint16s()
+		case 16: // application_layer_protocol_negotiation
+			protocols := body.vector(2)
+			for protocols.more() {
+				protocol := protocols.vector(1)
+				hello.alpnProtocols = append(hello.alpnProtocols, string(protocol.b))
+			}
+		case 43: // supported_versions
+			hello.supportedVersions = body.vector(1).uint16s()
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return hello, nil
+}
@@ -1,43 +1,35 @@
 package main
 
 import (
-	gotls "crypto/tls"
 	"fmt"
-	"golang.org/x/net/http2"
 	"httpmod"
 	"io"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
-	"time"
+
+	utls "gitlab.com/yawning/utls.git"
 )
 
 func main() {
-	httpmod.Apply()
-
-	httpmod.InitialHeaderTableSize = 10485760
-	httpmod.MaxHeaderListSize = 65536
-	httpmod.TransportDefaultStreamFlow = 6291456
-	httpmod.MaxConcurrentStreams = 1000
-	httpmod.SettingEnablePush = 0
-	httpmod.MaxFrameSize = 16384
-
-	err := httpWithKeylog("https://postman-echo.com/get", "/tmp/banaan.txt")
+	err := httpWithKeylog("https://postman-echo.com/get", "/tmp/banaan.txt", "chrome_72")
 	if err != nil {
 		panic(err)
 	}
 
 }
 
-func httpWithKeylog(url, keyLogFileName string) error {
+func httpWithKeylog(url, keyLogFileName, profileName string) error {
 	kl, err := os.OpenFile(keyLogFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	fmt.Fprintf(kl, "# SSL/TLS secrets log file, generated by go\n")
 
-	client := http.Client{Transport: newTransportWithKeyLog(kl)}
+	client, err := newClientWithKeyLog(profileName, kl)
+	if err != nil {
+		return err
+	}
 
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
@@ -48,11 +40,9 @@ func httpWithKeylog(url, keyLogFileName string) error {
 	}
 	fmt.Printf("Leaking TLS keys to %s\n----------------------\n", keyLogFileName)
 
-	headers := make(httpmod.OrderedHeader)
-	headers.Add("SUP", "HEY")
-	headers.Add("NON-Ordered", "VALUE")
-
-	req.Header = http.Header(headers)
+	// the profile adds its own headers, these follow them
+	req.Header.Set("Sup", "HEY")
+	req.Header.Set("Non-Ordered", "VALUE")
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -66,25 +56,12 @@ func httpWithKeylog(url, keyLogFileName string) error {
 	return nil
 }
 
-// newTransportWithKeyLog initializes a HTTP Transport with KeyLogWriter
-func newTransportWithKeyLog(keyLog io.Writer) *http.Transport {
-	transport := &http.Transport{
-		TLSClientConfig: &gotls.Config{KeyLogWriter: keyLog},
-
-		// Copy of http.DefaultTransport
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	if err := http2.ConfigureTransport(transport); err != nil {
-		panic(err)
+// newClientWithKeyLog returns a client presenting the named profile, with a
+// KeyLogWriter so the traffic can be inspected in wireshark
+func newClientWithKeyLog(profileName string, keyLog io.Writer) (*http.Client, error) {
+	profile, err := httpmod.ProfileByName(profileName)
+	if err != nil {
+		return nil, err
 	}
-	return transport
-}
\ No newline at end of file
+	return httpmod.NewClient(profile, &utls.Config{KeyLogWriter: keyLog}, nil)
+}
@@ -0,0 +1,75 @@
+package httpmod
+
+import "strings"
+
+// CookiePlacement says where the cookie fields of a request go among its
+// other HTTP/2 headers.
+type CookiePlacement int
+
+const (
+	// CookiesInOrder treats cookie like any other header, it goes where
+	// the header order puts it.
+	CookiesInOrder CookiePlacement = iota
+
+	// CookiesFirst sends the cookie fields right after the pseudo headers.
+	CookiesFirst
+
+	// CookiesLast sends the cookie fields after all other headers.
+	CookiesLast
+)
+
+// cookieFields returns the values of the cookie fields to send for the
+// Cookie header values vv. Per 8.1.2.5 of RFC 7540 the header may be split
+// into a field per cookie-pair, which is what Chrome and x/net do. combine
+// joins all pairs into a single field instead.
+func cookieFields(vv []string, combine bool) []string {
+	var pairs []string
+	for _, v := range vv {
+		for {
+			p := strings.IndexByte(v, ';')
+			if p < 0 {
+				break
+			}
+			pairs = append(pairs, v[:p])
+			p++
+			// strip space after semicolon if any.
+			for p+1 <= len(v) && v[p] == ' ' {
+				p++
+			}
+			v = v[p:]
+		}
+		if len(v) > 0 {
+			pairs = append(pairs, v)
+		}
+	}
+
+	if combine && len(pairs) > 0 {
+		return []string{strings.Join(pairs, "; ")}
+	}
+	return pairs
+}
+
+// placeCookies moves cookie within names as placement asks.
+func placeCookies(names []string, placement CookiePlacement) []string {
+	if placement == CookiesInOrder {
+		return names
+	}
+
+	result := make([]string, 0, len(names))
+	var found bool
+	for _, name := range names {
+		if strings.EqualFold(name, "cookie") {
+			found = true
+			continue
+		}
+		result = append(result, name)
+	}
+	if !found {
+		return names
+	}
+
+	if placement == CookiesFirst {
+		return append([]string{"cookie"}, result...)
+	}
+	return append(result, "cookie")
+}
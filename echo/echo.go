@@ -0,0 +1,283 @@
+// Package echo runs a local HTTPS server that answers every request with
+// what the client revealed about itself: its ClientHello, the HTTP/2 frames
+// it opened the connection with and its headers in the order and casing
+// they were sent in. It lets the fingerprint of a client be checked without
+// a public echo service.
+package echo
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"httpmod"
+)
+
+// Report is what the server saw of a client, it is the JSON body of every
+// response.
+type Report struct {
+	// ClientHello is the TLS record holding the ClientHello, hex encoded.
+	ClientHello string `json:"client_hello"`
+	JA3         string `json:"ja3"`
+	JA3Hash     string `json:"ja3_hash"`
+	JA4         string `json:"ja4"`
+
+	// ALPN lists the protocols the client offered, NegotiatedProtocol is
+	// the one the server picked.
+	ALPN               []string `json:"alpn"`
+	NegotiatedProtocol string   `json:"negotiated_protocol"`
+
+	// HTTP2 is only set for h2 connections.
+	HTTP2 *HTTP2Report `json:"http2,omitempty"`
+
+	Proto  string `json:"proto"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	// Headers are the request headers as they were sent, including the
+	// pseudo headers on HTTP/2.
+	Headers []Header `json:"headers"`
+}
+
+// HTTP2Report holds the frames an HTTP/2 client opened the connection
+// with.
+type HTTP2Report struct {
+	Settings          []Setting  `json:"settings"`
+	WindowUpdate      uint32     `json:"window_update"`
+	PriorityFrames    []Priority `json:"priority_frames"`
+	HeadersPriority   *Priority  `json:"headers_priority,omitempty"`
+	PseudoHeaderOrder []string   `json:"pseudo_header_order"`
+	Akamai            string     `json:"akamai"`
+}
+
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Setting struct {
+	ID    uint16 `json:"id"`
+	Value uint32 `json:"value"`
+}
+
+// Priority is a stream priority, with the weight from 1 to 256.
+type Priority struct {
+	StreamID  uint32 `json:"stream_id"`
+	DependsOn uint32 `json:"depends_on"`
+	Weight    int    `json:"weight"`
+	Exclusive bool   `json:"exclusive"`
+}
+
+// Server is an echo server listening on a loopback address, with a self
+// signed certificate for 127.0.0.1 and localhost.
+type Server struct {
+	// URL is the base URL of the server, e.g. https://127.0.0.1:43021.
+	URL string
+
+	listener    net.Listener
+	config      *tls.Config
+	certificate *x509.Certificate
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+// NewServer starts an echo server. Close it when done.
+func NewServer() (*Server, error) {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		URL:         "https://" + l.Addr().String(),
+		listener:    l,
+		certificate: cert.Leaf,
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		},
+		conns: make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Certificate returns the certificate of the server.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// CertPool returns a pool holding the certificate of the server, for the
+// RootCAs of a client.
+func (s *Server) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.certificate)
+	return pool
+}
+
+// Close stops the server and closes the connections it has open.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(c)
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+
+	rc := &recordingConn{Conn: c, recording: true}
+	report := &Report{}
+	config := s.config.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		report.ALPN = hello.SupportedProtos
+		return nil, nil
+	}
+
+	tc := tls.Server(rc, config)
+	if err := tc.Handshake(); err != nil {
+		return
+	}
+	rc.stopRecording()
+
+	hello := firstRecord(rc.recorded.Bytes())
+	report.ClientHello = hex.EncodeToString(hello)
+	report.JA3, _ = httpmod.JA3(hello)
+	report.JA3Hash = httpmod.JA3Hash(report.JA3)
+	report.JA4, _ = httpmod.JA4(hello)
+	report.NegotiatedProtocol = tc.ConnectionState().NegotiatedProtocol
+
+	if report.NegotiatedProtocol == "h2" {
+		serveHTTP2(tc, report)
+	} else {
+		serveHTTP1(tc, report)
+	}
+}
+
+// requestReport returns a copy of the connection report for a request.
+func requestReport(conn *Report, proto, method, path string, headers []Header) []byte {
+	report := *conn
+	report.Proto = proto
+	report.Method = method
+	report.Path = path
+	report.Headers = headers
+
+	body, _ := json.MarshalIndent(&report, "", "  ")
+	return append(body, '\n')
+}
+
+// recordingConn keeps what is read from it until stopRecording is called.
+type recordingConn struct {
+	net.Conn
+
+	recording bool
+	recorded  bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.recording {
+		c.recorded.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *recordingConn) stopRecording() {
+	c.recording = false
+}
+
+// firstRecord returns the first TLS record in data, header included.
+func firstRecord(data []byte) []byte {
+	if len(data) < 5 {
+		return data
+	}
+	length := 5 + (int(data[3])<<8 | int(data[4]))
+	if length > len(data) {
+		return data
+	}
+	return data[:length]
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"httpmod echo"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// discard reads r until it ends.
+func discard(r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
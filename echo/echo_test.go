@@ -0,0 +1,162 @@
+package echo
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	utls "gitlab.com/yawning/utls.git"
+	"golang.org/x/net/http2"
+
+	"httpmod"
+)
+
+// get fetches the report of a request sent by a client presenting profile.
+func get(t *testing.T, s *Server, profile *httpmod.Profile) *Report {
+	client, err := httpmod.NewClient(profile, &utls.Config{RootCAs: s.CertPool()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(s.URL + "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	report := &Report{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"firefox_65", "curl"} {
+		profile, err := httpmod.ProfileByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report := get(t, s, profile)
+		if report.Proto != "HTTP/2.0" || report.Method != "GET" || report.Path != "/echo" {
+			t.Errorf("%s: got %s %s %s", name, report.Proto, report.Method, report.Path)
+		}
+		if report.JA3 == "" || report.HTTP2 == nil || report.HTTP2.Akamai == "" {
+			t.Errorf("%s: fingerprints missing from %+v", name, report)
+		}
+	}
+}
+
+func TestServerFlowControl(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a stream window far smaller than the report
+	profile, err := httpmod.ProfileByName("firefox_65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, setting := range profile.H2Settings.Settings {
+		if setting.ID == http2.SettingInitialWindowSize {
+			profile.H2Settings.Settings[i].Val = 256
+		}
+	}
+
+	report := get(t, s, profile)
+	if report.ClientHello == "" {
+		t.Error("report without a ClientHello")
+	}
+}
+
+func TestServerH1ConnectionClose(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tr := &httpmod.H1Transport{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			return tls.Dial(network, addr, &tls.Config{RootCAs: s.CertPool(), NextProtos: []string{"http/1.1"}})
+		},
+		HeaderOrder:        []string{"Host", "Connection", "User-Agent", "Accept"},
+		DisableCompression: true,
+	}
+	defer tr.CloseIdleConnections()
+
+	tests := []struct {
+		name    string
+		close   bool
+		header  http.Header
+		headers string // as they were sent
+	}{
+		{
+			name:    "close",
+			close:   true,
+			header:  http.Header{"Accept": {"*/*"}},
+			headers: "Host,Connection: close,User-Agent,Accept",
+		},
+		{
+			name:    "caller's Connection",
+			close:   true,
+			header:  http.Header{"Accept": {"*/*"}, "Connection": {"keep-alive"}},
+			headers: "Host,Connection: keep-alive,User-Agent,Accept",
+		},
+		{
+			name:    "suppressed",
+			close:   true,
+			header:  http.Header{"Accept": {"*/*"}, "Connection": nil},
+			headers: "Host,User-Agent,Accept",
+		},
+		{
+			name:    "keep-alive",
+			header:  http.Header{"Accept": {"*/*"}},
+			headers: "Host,User-Agent,Accept",
+		},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", s.URL+"/echo", nil)
+		req.Close = test.close
+		req.Header = test.header
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		report := &Report{}
+		err = json.NewDecoder(resp.Body).Decode(report)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var headers []string
+		for _, h := range report.Headers {
+			if h.Name == "Connection" {
+				headers = append(headers, h.Name+": "+h.Value)
+			} else {
+				headers = append(headers, h.Name)
+			}
+		}
+		if got := strings.Join(headers, ","); got != test.headers {
+			t.Errorf("%s: sent %s, want %s", test.name, got, test.headers)
+		}
+	}
+}
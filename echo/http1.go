@@ -0,0 +1,95 @@
+package echo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// serveHTTP1 answers the HTTP/1.1 requests on c. The request head is parsed
+// by hand, net/http would canonicalize the header names and lose their
+// order.
+func serveHTTP1(c net.Conn, report *Report) {
+	br := bufio.NewReader(c)
+	for {
+		method, path, proto, headers, err := readRequestHead(br)
+		if err != nil {
+			return
+		}
+
+		var body io.Reader = strings.NewReader("")
+		closeAfter := proto == "HTTP/1.0"
+		for _, h := range headers {
+			switch strings.ToLower(h.Name) {
+			case "content-length":
+				n, err := strconv.ParseInt(h.Value, 10, 64)
+				if err != nil || n < 0 {
+					return
+				}
+				body = io.LimitReader(br, n)
+			case "transfer-encoding":
+				if strings.EqualFold(h.Value, "chunked") {
+					body = httputil.NewChunkedReader(br)
+				}
+			case "connection":
+				closeAfter = strings.EqualFold(h.Value, "close")
+			}
+		}
+		if err := discard(body); err != nil {
+			return
+		}
+
+		response := requestReport(report, proto, method, path, headers)
+		fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n", len(response))
+		if closeAfter {
+			fmt.Fprintf(c, "Connection: close\r\n")
+		}
+		fmt.Fprintf(c, "\r\n")
+		if _, err := c.Write(response); err != nil || closeAfter {
+			return
+		}
+	}
+}
+
+// readRequestHead reads a request line and the header lines following it.
+func readRequestHead(br *bufio.Reader) (method, path, proto string, headers []Header, err error) {
+	line, err := readLine(br)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return "", "", "", nil, fmt.Errorf("malformed request line %q", line)
+	}
+	method, path, proto = parts[0], parts[1], parts[2]
+
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return "", "", "", nil, err
+		}
+		if line == "" {
+			return method, path, proto, headers, nil
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return "", "", "", nil, fmt.Errorf("malformed header line %q", line)
+		}
+		headers = append(headers, Header{
+			Name:  line[:i],
+			Value: strings.TrimSpace(line[i+1:]),
+		})
+	}
+}
+
+func readLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,209 @@
+package echo
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"httpmod"
+)
+
+// serveHTTP2 answers the HTTP/2 requests on c. The frames sent before the
+// first HEADERS frame are recorded in report, they make up the Akamai
+// fingerprint.
+func serveHTTP2(c net.Conn, report *Report) {
+	rc := &recordingConn{Conn: c, recording: true}
+	br := bufio.NewReader(rc)
+	bw := bufio.NewWriter(c)
+
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(br, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+
+	fr := http2.NewFramer(bw, br)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	fr.WriteSettings()
+	if err := bw.Flush(); err != nil {
+		return
+	}
+
+	h2 := &HTTP2Report{}
+	report.HTTP2 = h2
+
+	var hbuf bytes.Buffer
+	henc := hpack.NewEncoder(&hbuf)
+	flow := &h2Flow{fr: fr, conn: 65535, initial: 65535}
+	var seenHeaders bool
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+			f.ForeachSetting(func(s http2.Setting) error {
+				if !seenHeaders {
+					h2.Settings = append(h2.Settings, Setting{ID: uint16(s.ID), Value: s.Val})
+				}
+				if s.ID == http2.SettingInitialWindowSize {
+					flow.setInitial(int32(s.Val))
+				}
+				return nil
+			})
+			fr.WriteSettingsAck()
+			flow.write()
+		case *http2.WindowUpdateFrame:
+			if f.StreamID == 0 && !seenHeaders && h2.WindowUpdate == 0 {
+				h2.WindowUpdate = f.Increment
+			}
+			flow.add(f.StreamID, int32(f.Increment))
+			flow.write()
+		case *http2.RSTStreamFrame:
+			flow.drop(f.StreamID)
+		case *http2.PriorityFrame:
+			if !seenHeaders {
+				h2.PriorityFrames = append(h2.PriorityFrames, priority(f.StreamID, f.PriorityParam))
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				fr.WritePing(true, f.Data)
+			}
+		case *http2.GoAwayFrame:
+			return
+		case *http2.MetaHeadersFrame:
+			if !seenHeaders {
+				seenHeaders = true
+				if f.HasPriority() {
+					p := priority(f.StreamID, f.Priority)
+					h2.HeadersPriority = &p
+				}
+				for _, field := range f.PseudoFields() {
+					h2.PseudoHeaderOrder = append(h2.PseudoHeaderOrder, field.Name)
+				}
+				rc.stopRecording()
+				h2.Akamai, _ = httpmod.AkamaiFingerprint(rc.recorded.Bytes())
+			}
+
+			var headers []Header
+			for _, field := range f.Fields {
+				headers = append(headers, Header{Name: field.Name, Value: field.Value})
+			}
+			body := requestReport(report, "HTTP/2.0", f.PseudoValue("method"), f.PseudoValue("path"), headers)
+
+			hbuf.Reset()
+			henc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			henc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/json"})
+			henc.WriteField(hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body))})
+			fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      f.StreamID,
+				BlockFragment: hbuf.Bytes(),
+				EndHeaders:    true,
+			})
+			flow.streams = append(flow.streams, &h2Stream{id: f.StreamID, body: body, window: flow.initial})
+			flow.write()
+		}
+
+		if err := bw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// h2Flow holds the response bodies that wait for the flow-control windows
+// of the client.
+type h2Flow struct {
+	fr      *http2.Framer
+	conn    int32 // the connection window
+	initial int32 // the window of new streams
+	streams []*h2Stream
+}
+
+// h2Stream is a response body that hasn't been sent in full.
+type h2Stream struct {
+	id     uint32
+	body   []byte
+	window int32
+}
+
+// setInitial changes the window of new streams, and that of the open ones
+// by the same amount.
+func (fl *h2Flow) setInitial(window int32) {
+	for _, s := range fl.streams {
+		s.window += window - fl.initial
+	}
+	fl.initial = window
+}
+
+// add grows the window of streamID, or that of the connection for 0.
+func (fl *h2Flow) add(streamID uint32, increment int32) {
+	if streamID == 0 {
+		fl.conn += increment
+		return
+	}
+	for _, s := range fl.streams {
+		if s.id == streamID {
+			s.window += increment
+		}
+	}
+}
+
+// drop forgets the body of a stream the client reset.
+func (fl *h2Flow) drop(streamID uint32) {
+	for i, s := range fl.streams {
+		if s.id == streamID {
+			fl.streams = append(fl.streams[:i:i], fl.streams[i+1:]...)
+			return
+		}
+	}
+}
+
+// write sends as much of the bodies as the windows allow, in frames of at
+// most 16KB, the smallest MAX_FRAME_SIZE a client may set.
+func (fl *h2Flow) write() {
+	var waiting []*h2Stream
+	for _, s := range fl.streams {
+		if len(s.body) == 0 {
+			fl.fr.WriteData(s.id, true, nil)
+			continue
+		}
+		for len(s.body) > 0 && fl.conn > 0 && s.window > 0 {
+			n := len(s.body)
+			if n > 16<<10 {
+				n = 16 << 10
+			}
+			if n > int(fl.conn) {
+				n = int(fl.conn)
+			}
+			if n > int(s.window) {
+				n = int(s.window)
+			}
+			fl.fr.WriteData(s.id, n == len(s.body), s.body[:n])
+			s.body = s.body[n:]
+			fl.conn -= int32(n)
+			s.window -= int32(n)
+		}
+		if len(s.body) > 0 {
+			waiting = append(waiting, s)
+		}
+	}
+	fl.streams = waiting
+}
+
+func priority(streamID uint32, param http2.PriorityParam) Priority {
+	return Priority{
+		StreamID:  streamID,
+		DependsOn: param.StreamDep,
+		Weight:    int(param.Weight) + 1,
+		Exclusive: param.Exclusive,
+	}
+}
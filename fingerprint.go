@@ -0,0 +1,125 @@
+package httpmod
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net/http"
+
+	utls "gitlab.com/yawning/utls.git"
+	"golang.org/x/net/http2"
+)
+
+// Fingerprint holds the fingerprints a client presents when it opens a
+// connection.
+type Fingerprint struct {
+	JA3     string
+	JA3Hash string
+	JA4     string
+
+	// Akamai is the Akamai HTTP/2 fingerprint, it is only seen by servers
+	// that negotiate h2.
+	Akamai string
+}
+
+// Fingerprint returns the fingerprints rt presents to serverName. They are
+// computed from the ClientHello and HTTP/2 frames rt would write, nothing is
+// sent.
+func (rt *UTLSRoundTripper) Fingerprint(serverName string) (*Fingerprint, error) {
+	rt.Lock()
+	settings := rt.h2Settings
+	rt.Unlock()
+
+	if settings == nil {
+		// what H2Transport falls back to
+		settings = DefaultH2Settings()
+	}
+	return computeFingerprint(serverName, rt.config, rt.clientHelloID, rt.clientHelloSpec, settings)
+}
+
+// Fingerprint returns the fingerprints a client made by NewClient from p
+// presents to serverName, without sending anything.
+func (p *Profile) Fingerprint(serverName string) (*Fingerprint, error) {
+	return computeFingerprint(serverName, nil, p.ClientHelloID, p.ClientHelloSpec, p.h2Settings())
+}
+
+func computeFingerprint(serverName string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, clientHelloSpec func() *utls.ClientHelloSpec, settings *H2Settings) (*Fingerprint, error) {
+	hello, err := marshalClientHello(serverName, cfg, clientHelloID, clientHelloSpec)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := marshalClientPreface(serverName, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	fp := &Fingerprint{}
+	if fp.JA3, err = JA3(hello); err != nil {
+		return nil, err
+	}
+	fp.JA3Hash = JA3Hash(fp.JA3)
+	if fp.JA4, err = JA4(hello); err != nil {
+		return nil, err
+	}
+	if fp.Akamai, err = AkamaiFingerprint(frames); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// marshalClientHello returns the ClientHello dialUTLS would send to
+// serverName.
+func marshalClientHello(serverName string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, clientHelloSpec func() *utls.ClientHelloSpec) ([]byte, error) {
+	// ApplyPreset wants the server name, uTLS writes to the config
+	if cfg == nil {
+		cfg = &utls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+
+	var uconn *utls.UConn
+	switch {
+	case clientHelloSpec != nil:
+		uconn = utls.UClient(nil, cfg, utls.HelloCustom)
+		if err := uconn.ApplyPreset(clientHelloSpec()); err != nil {
+			return nil, err
+		}
+	case clientHelloID != nil:
+		uconn = utls.UClient(nil, cfg, *clientHelloID)
+	default:
+		return nil, errors.New("neither a ClientHelloID nor a ClientHelloSpec")
+	}
+
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	return uconn.HandshakeState.Hello.Raw, nil
+}
+
+// marshalClientPreface returns what a connection presenting settings writes
+// before its first response: the preface, the frames writeClientPreface
+// adds and the HEADERS of a GET for the root of serverName.
+func marshalClientPreface(serverName string, settings *H2Settings) ([]byte, error) {
+	var buf bytes.Buffer
+	fr := http2.NewFramer(&buf, nil)
+	nextStreamID := uint32(1)
+	writeClientPreface(&buf, fr, settings, &nextStreamID)
+
+	req, err := http.NewRequest("GET", "https://"+serverName+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	var hbuf bytes.Buffer
+	enc := newHPACKEncoder(&hbuf, settings)
+	err = encodeRequestHeaders(req, settings, true, "", 0, math.MaxUint64, func(name, value string) {
+		enc.WriteField(name, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeHeaderBlock(fr, nextStreamID, true, 16<<10, headersPriority(req, settings), hbuf.Bytes())
+	return buf.Bytes(), nil
+}
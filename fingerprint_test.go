@@ -0,0 +1,213 @@
+package httpmod
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	utls "gitlab.com/yawning/utls.git"
+)
+
+// readHexFixture reads a capture from testdata, written as hex.
+func readHexFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hex.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return b
+}
+
+func TestClientHelloFingerprints(t *testing.T) {
+	tests := []struct {
+		fixture string
+		ja3     string
+		ja3Hash string
+		ja4     string
+	}{
+		{
+			// the Chrome ClientHello the JA4 specification uses as its
+			// example, GREASE, ALPS and padding included
+			fixture: "foxio_example.clienthello.hex",
+			ja3:     "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			ja3Hash: "cd08e31494f9531f560d64c695473da9",
+			ja4:     "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			// crypto/tls offering h2 and http/1.1 to example.com
+			fixture: "crypto_tls.clienthello.hex",
+			ja3:     "771,49195-49199-49196-49200-52393-52392-49161-49171-49162-49172-4865-4866-4867,0-11-65281-23-18-5-10-13-50-16-43-51,29-23-24-25,0",
+			ja3Hash: "95b6f6d62c2c0f5258859e829e0055f5",
+			ja4:     "t13d1312h2_f57a46bbacb6_a089bac06eae",
+		},
+	}
+
+	for _, test := range tests {
+		record := readHexFixture(t, test.fixture)
+		// the handshake message alone must give the same fingerprints
+		for _, hello := range [][]byte{record, record[5:]} {
+			ja3, err := JA3(hello)
+			if err != nil {
+				t.Fatalf("%s: JA3: %v", test.fixture, err)
+			}
+			if ja3 != test.ja3 {
+				t.Errorf("%s: JA3 = %s, want %s", test.fixture, ja3, test.ja3)
+			}
+			if hash := JA3Hash(ja3); hash != test.ja3Hash {
+				t.Errorf("%s: JA3 hash = %s, want %s", test.fixture, hash, test.ja3Hash)
+			}
+			ja4, err := JA4(hello)
+			if err != nil {
+				t.Fatalf("%s: JA4: %v", test.fixture, err)
+			}
+			if ja4 != test.ja4 {
+				t.Errorf("%s: JA4 = %s, want %s", test.fixture, ja4, test.ja4)
+			}
+		}
+	}
+}
+
+func TestClientHelloFingerprintErrors(t *testing.T) {
+	record := readHexFixture(t, "crypto_tls.clienthello.hex")
+	for i, hello := range [][]byte{
+		nil,
+		record[:40],
+		record[:len(record)-3],
+		append([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02}, record[6:]...), // ServerHello
+	} {
+		if _, err := JA3(hello); err == nil {
+			t.Errorf("JA3 of broken ClientHello %d succeeded", i)
+		}
+		if _, err := JA4(hello); err == nil {
+			t.Errorf("JA4 of broken ClientHello %d succeeded", i)
+		}
+	}
+}
+
+func TestAkamaiFingerprint(t *testing.T) {
+	tests := []struct {
+		fixture string
+		akamai  string
+	}{
+		{
+			// golang.org/x/net/http2.Transport
+			fixture: "x_net.h2preface.hex",
+			akamai:  "2:0;4:4194304;6:10485760|1073741824|0|a,m,p,s",
+		},
+		{
+			// the firefox_65 profile, which matches the published
+			// fingerprint of Firefox
+			fixture: "firefox_65.h2preface.hex",
+			akamai:  "1:65536;4:131072;5:16384|12517377|3:0:0:201,5:0:0:101,7:0:0:1,9:0:7:1,11:0:3:1,13:0:0:241|m,p,a,s",
+		},
+	}
+
+	for _, test := range tests {
+		akamai, err := AkamaiFingerprint(readHexFixture(t, test.fixture))
+		if err != nil {
+			t.Fatalf("%s: %v", test.fixture, err)
+		}
+		if akamai != test.akamai {
+			t.Errorf("%s: Akamai = %s, want %s", test.fixture, akamai, test.akamai)
+		}
+	}
+
+	if _, err := AkamaiFingerprint([]byte("GET / HTTP/1.1\r\n\r\n")); err == nil {
+		t.Error("AkamaiFingerprint accepted a request without the HTTP/2 preface")
+	}
+}
+
+func TestClientHelloIDByName(t *testing.T) {
+	tests := []struct {
+		name string
+		id   *utls.ClientHelloID
+		err  bool
+	}{
+		{name: "hellochrome_72", id: &utls.HelloChrome_72},
+		{name: "HelloChrome_72", id: &utls.HelloChrome_72},
+		{name: "HELLOIOS_12_1", id: &utls.HelloIOS_12_1},
+		{name: "none"},
+		{name: "HelloGolang"},
+		{name: "hellocustom", err: true},
+		{name: "chrome_72", err: true},
+		{name: "", err: true},
+	}
+
+	names := ClientHelloIDNames()
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("ClientHelloIDNames() = %q, not sorted", names)
+	}
+	for _, test := range tests {
+		id, err := ClientHelloIDByName(test.name)
+		if (err != nil) != test.err {
+			t.Errorf("ClientHelloIDByName(%q): got error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if id != test.id {
+			t.Errorf("ClientHelloIDByName(%q) = %v, want %v", test.name, id, test.id)
+		}
+		i := sort.SearchStrings(names, strings.ToLower(test.name))
+		if listed := i < len(names) && names[i] == strings.ToLower(test.name); listed == test.err {
+			t.Errorf("ClientHelloIDNames() lists %q: %v, want %v", test.name, listed, !test.err)
+		}
+	}
+}
+
+func TestNewUTLSRoundTripperByName(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := []struct {
+		name   string
+		stdlib bool
+		err    bool
+	}{
+		{name: "none", stdlib: true},
+		{name: "HelloGolang", stdlib: true},
+		{name: "HelloFirefox_65"},
+		{name: "hellochrome_auto"},
+		{name: "hellonetscape_4", err: true},
+	}
+
+	for _, test := range tests {
+		rt, err := NewUTLSRoundTripperByName(test.name, &utls.Config{RootCAs: roots, ServerName: "example.com"}, nil)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if _, ok := rt.(*UTLSRoundTripper); ok == test.stdlib {
+			t.Errorf("%s: got a %T", test.name, rt)
+		}
+		if !test.stdlib {
+			continue
+		}
+
+		// crypto/tls gets the settings of the uTLS config
+		transport := rt.(*http.Transport)
+		if config := transport.TLSClientConfig; config == nil || config.RootCAs != roots || config.ServerName != "example.com" {
+			t.Errorf("%s: the TLS config lacks the roots or server name of the uTLS config", test.name)
+			continue
+		}
+		resp, err := rt.RoundTrip(mustRequest(t, "GET", server.URL, nil))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+		transport.CloseIdleConnections()
+	}
+}
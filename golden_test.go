@@ -0,0 +1,270 @@
+package httpmod
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	utls "gitlab.com/yawning/utls.git"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The golden tests capture what a client presenting a built-in profile writes
+// to an in-memory peer, and compare it with testdata/<profile>.tls.golden and
+// testdata/<profile>.h2.golden. Run go test -update to rewrite them after a
+// deliberate change.
+
+func TestGoldenClientHello(t *testing.T) {
+	for _, name := range ProfileNames() {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			p, err := ProfileByName(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hello := captureClientHello(t, p)
+			checkGolden(t, name+".tls.golden", describeClientHello(t, hello))
+		})
+	}
+}
+
+func TestGoldenH2Preface(t *testing.T) {
+	for _, name := range ProfileNames() {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			p, err := ProfileByName(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, name+".h2.golden", captureH2Preface(t, p))
+		})
+	}
+}
+
+// pipeDialer hands out a connection made up front.
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+// captureClientHello returns the ClientHello record p sends to example.com.
+func captureClientHello(t *testing.T, p *Profile) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// fails once the peer hangs up
+		uconn, err := dialUTLS("tcp", "example.com:443", &utls.Config{}, p.ClientHelloID, p.ClientHelloSpec, pipeDialer{client})
+		if err == nil {
+			uconn.Close()
+		}
+	}()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+(int(header[3])<<8|int(header[4])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	<-done
+	return record
+}
+
+// describeClientHello lists the fields of hello that make up its
+// fingerprint. GREASE values and everything random are left out.
+func describeClientHello(t *testing.T, hello []byte) []byte {
+	parsed, err := parseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ja3, err := JA3(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ja4, err := JA4(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := make([]uint16, len(parsed.pointFormats))
+	for i, format := range parsed.pointFormats {
+		points[i] = uint16(format)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "version: %s\n", formatGoldenValues([]uint16{parsed.version}))
+	fmt.Fprintf(&b, "cipher_suites: %s\n", formatGoldenValues(parsed.cipherSuites))
+	fmt.Fprintf(&b, "extensions: %s\n", formatGoldenValues(parsed.extensions))
+	fmt.Fprintf(&b, "curves: %s\n", formatGoldenValues(parsed.curves))
+	fmt.Fprintf(&b, "point_formats: %s\n", formatGoldenValues(points))
+	fmt.Fprintf(&b, "signature_algorithms: %s\n", formatGoldenValues(parsed.signatureAlgorithms))
+	fmt.Fprintf(&b, "alpn: %s\n", strings.Join(parsed.alpnProtocols, " "))
+	fmt.Fprintf(&b, "supported_versions: %s\n", formatGoldenValues(parsed.supportedVersions))
+	fmt.Fprintf(&b, "ja3: %s\n", ja3)
+	fmt.Fprintf(&b, "ja3_hash: %s\n", JA3Hash(ja3))
+	fmt.Fprintf(&b, "ja4: %s\n", ja4)
+	return b.Bytes()
+}
+
+func formatGoldenValues(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		if isGREASE(v) {
+			s[i] = "GREASE"
+		} else {
+			s[i] = fmt.Sprintf("0x%04x", v)
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+// captureH2Preface describes the frames a client presenting p writes before
+// the HEADERS of its first request, and that HEADERS block.
+func captureH2Preface(t *testing.T, p *Profile) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	rt := &profileRoundTripper{
+		rt: &H2Transport{
+			Settings: p.h2Settings(),
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				return client, nil
+			},
+		},
+		headers: p.Headers,
+	}
+	req, err := http.NewRequest("GET", "https://example.com/golden?q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Cookie", "a=1; b=2")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// fails once the peer hangs up
+		res, err := rt.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	var b bytes.Buffer
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(server, preface); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(&b, "preface: %q\n", preface)
+
+	fr := http2.NewFramer(ioutil.Discard, server)
+	var block []byte
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			fmt.Fprintf(&b, "SETTINGS")
+			f.ForeachSetting(func(s http2.Setting) error {
+				fmt.Fprintf(&b, " %d:%d", s.ID, s.Val)
+				return nil
+			})
+			fmt.Fprintf(&b, "\n")
+		case *http2.WindowUpdateFrame:
+			fmt.Fprintf(&b, "WINDOW_UPDATE stream=%d increment=%d\n", f.StreamID, f.Increment)
+		case *http2.PriorityFrame:
+			fmt.Fprintf(&b, "PRIORITY stream=%d %s\n", f.StreamID, formatGoldenPriority(f.PriorityParam))
+		case *http2.HeadersFrame:
+			fmt.Fprintf(&b, "HEADERS stream=%d end_stream=%t", f.StreamID, f.StreamEnded())
+			if f.HasPriority() {
+				fmt.Fprintf(&b, " %s", formatGoldenPriority(f.Priority))
+			}
+			fmt.Fprintf(&b, "\n")
+			block = append(block, f.HeaderBlockFragment()...)
+			if !f.HeadersEnded() {
+				continue
+			}
+		case *http2.ContinuationFrame:
+			fmt.Fprintf(&b, "CONTINUATION stream=%d\n", f.StreamID)
+			block = append(block, f.HeaderBlockFragment()...)
+			if !f.HeadersEnded() {
+				continue
+			}
+		default:
+			fmt.Fprintf(&b, "%v\n", f.Header())
+			continue
+		}
+		if block != nil {
+			break
+		}
+	}
+	server.Close()
+	cancel()
+	<-done
+
+	fmt.Fprintf(&b, "block: %s\n", hex.EncodeToString(block))
+	fields, err := hpack.NewDecoder(4096, nil).DecodeFull(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range fields {
+		fmt.Fprintf(&b, "%s: %s\n", field.Name, field.Value)
+	}
+	return b.Bytes()
+}
+
+func formatGoldenPriority(param http2.PriorityParam) string {
+	return fmt.Sprintf("dep=%d weight=%d exclusive=%t", param.StreamDep, int(param.Weight)+1, param.Exclusive)
+}
+
+// checkGolden compares got with the golden file name, or rewrites it with
+// -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Skipf("%s doesn't exist yet, run go test -update", path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs, run go test -update if this is intended\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
@@ -0,0 +1,648 @@
+package httpmod
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// defaultUserAgent is sent by H1Transport when the request doesn't mention
+// User-Agent at all, like net/http does.
+const defaultUserAgent = "Go-http-client/1.1"
+
+// maxIdleConnsPerHost bounds the idle connections an H1Transport keeps.
+const maxIdleConnsPerHost = 2
+
+var headerNewlineToSpace = strings.NewReplacer("\n", " ", "\r", " ")
+
+// H1Transport is an HTTP/1.1 client transport that writes requests itself,
+// so header order and casing are honored without Apply.
+type H1Transport struct {
+	// Dial dials plain connections for http URLs. If nil, net.Dial is
+	// used.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// DialTLS dials connections for https URLs that have already finished
+	// the TLS handshake. If nil, crypto/tls is used.
+	DialTLS func(network, addr string) (net.Conn, error)
+
+	// DisableCompression stops the transport from asking for gzip when the
+	// request doesn't set Accept-Encoding itself.
+	DisableCompression bool
+
+	// HeaderOrder is the order the headers of a request are written in,
+	// unless the request asks for its own, see WithHeaderOrder. It may hold
+	// UnlistedHeaders.
+	// Nil uses DefaultHeaderOrder.
+	HeaderOrder []string
+
+	// TLSHandshakeTimeout bounds the TLS handshake of connections the
+	// transport dials itself, DialTLS is left alone. Zero means no limit.
+	TLSHandshakeTimeout time.Duration
+
+	// IdleConnTimeout closes connections that were kept for reuse for that
+	// long. Zero means no limit.
+	IdleConnTimeout time.Duration
+
+	// ExpectContinueTimeout is how long a request with "Expect:
+	// 100-continue" waits for the server to answer its headers before the
+	// body is sent anyway. Zero sends the body right away.
+	ExpectContinueTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]*h1Conn // keyed by scheme and host:port
+	closed bool                 // set by closeWhenIdle, nothing is kept anymore
+}
+
+// h1Conn is a single HTTP/1.1 connection opened by an H1Transport.
+type h1Conn struct {
+	key  string
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+
+	idleTimer *time.Timer // closes the conn while it is kept, nil without an IdleConnTimeout
+}
+
+func (t *H1Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("http: nil Request.URL")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
+	}
+	addr, err := addrForDial(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != "" && !validMethod(req.Method) {
+		return nil, fmt.Errorf("net/http: invalid method %q", req.Method)
+	}
+	for _, h := range []http.Header{req.Header, req.Trailer} {
+		for k := range h {
+			if !httpguts.ValidHeaderFieldName(k) {
+				return nil, fmt.Errorf("net/http: invalid header field name %q", k)
+			}
+		}
+	}
+	key := req.URL.Scheme + "://" + addr
+
+	for {
+		pc, reused, err := t.getConn(key, req.URL.Scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+		res, err := t.roundTrip(pc, req)
+		// an idle connection may have been closed by the server in the
+		// meantime, try a fresh one if the request can be sent again
+		if err != nil && reused && req.Context().Err() == nil && isReplayable(req) {
+			if newReq, rerr := rewindBody(req); rerr == nil {
+				req = newReq
+				continue
+			}
+		}
+		return res, err
+	}
+}
+
+// validMethod reports whether method is a token, as RFC 7230 requires.
+func validMethod(method string) bool {
+	return len(method) > 0 && strings.IndexFunc(method, func(r rune) bool {
+		return !httpguts.IsTokenRune(r)
+	}) == -1
+}
+
+// isReplayable reports whether req may be sent again after a reused
+// connection failed, by the rules net/http follows: its body can be
+// rewound, and it is idempotent or carries an idempotency key.
+func isReplayable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	if _, ok := lookupHeader(req.Header, "Idempotency-Key"); ok {
+		return true
+	}
+	_, ok := lookupHeader(req.Header, "X-Idempotency-Key")
+	return ok
+}
+
+// CloseIdleConnections closes the connections kept for reuse.
+func (t *H1Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+	}
+}
+
+// closeWhenIdle closes the idle connections, and the ones in use once their
+// request is done.
+func (t *H1Transport) closeWhenIdle() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	t.CloseIdleConnections()
+}
+
+// getConn returns an idle connection for key or dials a new one. reused
+// reports whether the connection was idle.
+func (t *H1Transport) getConn(key, scheme, addr string) (pc *h1Conn, reused bool, err error) {
+	t.mu.Lock()
+	if conns := t.idle[key]; len(conns) > 0 {
+		pc = conns[len(conns)-1]
+		t.idle[key] = conns[:len(conns)-1]
+		t.mu.Unlock()
+		if pc.idleTimer != nil {
+			pc.idleTimer.Stop()
+		}
+		return pc, true, nil
+	}
+	t.mu.Unlock()
+
+	var conn net.Conn
+	if scheme == "https" {
+		conn, err = t.dialTLS("tcp", addr)
+	} else if t.Dial != nil {
+		conn, err = t.Dial("tcp", addr)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &h1Conn{
+		key:  key,
+		conn: conn,
+		br:   bufio.NewReader(conn),
+		bw:   bufio.NewWriter(conn),
+	}, false, nil
+}
+
+func (t *H1Transport) dialTLS(network, addr string) (net.Conn, error) {
+	if t.DialTLS != nil {
+		return t.DialTLS(network, addr)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: host,
+		NextProtos: []string{"http/1.1"},
+	})
+	if d := t.TLSHandshakeTimeout; d != 0 {
+		conn.SetDeadline(time.Now().Add(d))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// putIdleConn keeps pc around for the next request to the same origin.
+func (t *H1Transport) putIdleConn(pc *h1Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || len(t.idle[pc.key]) >= maxIdleConnsPerHost {
+		pc.conn.Close()
+		return
+	}
+	if t.idle == nil {
+		t.idle = make(map[string][]*h1Conn)
+	}
+	t.idle[pc.key] = append(t.idle[pc.key], pc)
+	if d := t.IdleConnTimeout; d != 0 {
+		pc.idleTimer = time.AfterFunc(d, func() { t.removeIdleConn(pc) })
+	}
+}
+
+// removeIdleConn closes pc if it is still kept for reuse.
+func (t *H1Transport) removeIdleConn(pc *h1Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conns := t.idle[pc.key]
+	for i, c := range conns {
+		if c == pc {
+			t.idle[pc.key] = append(conns[:i:i], conns[i+1:]...)
+			pc.conn.Close()
+			return
+		}
+	}
+}
+
+func (t *H1Transport) roundTrip(pc *h1Conn, req *http.Request) (*http.Response, error) {
+	// Ask for gzip like the stdlib does, and decompress transparently.
+	requestedGzip := !t.DisableCompression &&
+		req.Header.Get("Accept-Encoding") == "" &&
+		req.Header.Get("Range") == "" &&
+		req.Method != "HEAD"
+
+	// close the connection if the request is cancelled while in flight
+	done := make(chan struct{})
+	if ctx := req.Context(); ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				pc.conn.Close()
+			case <-done:
+			}
+		}()
+	}
+
+	order := t.HeaderOrder
+	if order == nil {
+		order = DefaultHeaderOrder
+	}
+
+	// a final response that came instead of 100 Continue
+	var early *http.Response
+	var waitForContinue func() (bool, error)
+	if t.ExpectContinueTimeout != 0 && expectsContinue(req) {
+		waitForContinue = func() (bool, error) {
+			var err error
+			early, err = t.awaitContinue(pc, req)
+			return early == nil, err
+		}
+	}
+	err := writeH1Request(pc.bw, req, requestedGzip, order, waitForContinue)
+	if err == nil {
+		err = pc.bw.Flush()
+	}
+	if err != nil {
+		close(done)
+		pc.conn.Close()
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	res := early
+	if res == nil {
+		res, err = http.ReadResponse(pc.br, req)
+	}
+	if err != nil {
+		close(done)
+		pc.conn.Close()
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	// the server may still expect the body we didn't send
+	reusable := !res.Close && !req.Close && early == nil
+	body := &h1Body{
+		body: res.Body,
+		release: func(sawEOF bool) {
+			close(done)
+			if sawEOF && reusable {
+				t.putIdleConn(pc)
+			} else {
+				pc.conn.Close()
+			}
+		},
+	}
+	if res.Body == http.NoBody {
+		body.release(true)
+	} else {
+		res.Body = body
+	}
+
+	if requestedGzip && res.Header.Get("Content-Encoding") == "gzip" {
+		res.Header.Del("Content-Encoding")
+		res.Header.Del("Content-Length")
+		res.ContentLength = -1
+		res.Body = &gzipReader{body: res.Body}
+		res.Uncompressed = true
+	}
+	return res, nil
+}
+
+// expectsContinue reports whether req has a body and asks the server to
+// approve it first.
+func expectsContinue(req *http.Request) bool {
+	vv, _ := lookupHeader(req.Header, "Expect")
+	return len(vv) > 0 && strings.EqualFold(vv[0], "100-continue") && actualContentLength(req) != 0
+}
+
+// awaitContinue waits up to ExpectContinueTimeout for the server to answer
+// the request headers already sent on pc. It returns the response if the
+// server answered with anything but 100 Continue, and nil if the body should
+// be sent.
+func (t *H1Transport) awaitContinue(pc *h1Conn, req *http.Request) (*http.Response, error) {
+	pc.conn.SetReadDeadline(time.Now().Add(t.ExpectContinueTimeout))
+	_, err := pc.br.Peek(1)
+	pc.conn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.ReadResponse(pc.br, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusContinue {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// h1Body hands the connection back once the response body has been read
+// to the end, or closes it if the body is closed early.
+type h1Body struct {
+	body    io.ReadCloser
+	once    sync.Once
+	release func(sawEOF bool)
+}
+
+func (b *h1Body) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err == io.EOF {
+		b.once.Do(func() { b.release(true) })
+	}
+	return n, err
+}
+
+func (b *h1Body) Close() error {
+	err := b.body.Close()
+	b.once.Do(func() { b.release(false) })
+	return err
+}
+
+// headerField is a single header line.
+type headerField struct {
+	name, value string
+}
+
+// writeH1Request writes req to w: the request line, the header fields in
+// the order given by the request or defaultOrder, and the body. If
+// waitForContinue is set, the headers are flushed and the body is only
+// written if it returns true.
+func writeH1Request(w *bufio.Writer, req *http.Request, addGzipHeader bool, defaultOrder []string, waitForContinue func() (bool, error)) (err error) {
+	trace := httptrace.ContextClientTrace(req.Context())
+	if trace != nil && trace.WroteRequest != nil {
+		defer func() {
+			trace.WroteRequest(httptrace.WroteRequestInfo{Err: err})
+		}()
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	host, err = httpguts.PunycodeHostPort(host)
+	if err != nil {
+		return err
+	}
+
+	ruri := req.URL.RequestURI()
+	if req.Method == "CONNECT" && req.URL.Path == "" {
+		// CONNECT requests normally give just the host and port, not a full URL.
+		ruri = host
+		if req.URL.Opaque != "" {
+			ruri = req.URL.Opaque
+		}
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	contentLength := actualContentLength(req)
+	chunked := contentLength < 0
+
+	// the order may give names another casing, check what goes on the wire
+	fields := h1HeaderFields(req, host, addGzipHeader, contentLength, chunked, defaultOrder)
+	for _, field := range fields {
+		if !httpguts.ValidHeaderFieldName(field.name) {
+			return fmt.Errorf("net/http: invalid header field name %q", field.name)
+		}
+	}
+
+	if _, err = fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", method, ruri); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		for _, s := range []string{field.name, ": ", headerNewlineToSpace.Replace(field.value), "\r\n"} {
+			if _, err = w.WriteString(s); err != nil {
+				return err
+			}
+		}
+		if trace != nil && trace.WroteHeaderField != nil {
+			trace.WroteHeaderField(field.name, []string{field.value})
+		}
+	}
+	if _, err = w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	if trace != nil && trace.WroteHeaders != nil {
+		trace.WroteHeaders()
+	}
+
+	if req.Body == nil {
+		return nil
+	}
+	defer req.Body.Close()
+	if contentLength == 0 {
+		return nil
+	}
+	if waitForContinue != nil {
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		if ok, err := waitForContinue(); !ok || err != nil {
+			return err
+		}
+	}
+
+	if !chunked {
+		n, err := io.Copy(w, io.LimitReader(req.Body, contentLength))
+		if err != nil {
+			return err
+		}
+		if n != contentLength {
+			return fmt.Errorf("http: ContentLength=%d with Body length %d", contentLength, n)
+		}
+		return nil
+	}
+
+	cw := httputil.NewChunkedWriter(w)
+	if _, err = io.Copy(cw, req.Body); err != nil {
+		return err
+	}
+	if err = cw.Close(); err != nil {
+		return err
+	}
+	for k, vv := range req.Trailer {
+		for _, v := range vv {
+			if _, err = fmt.Fprintf(w, "%s: %s\r\n", k, headerNewlineToSpace.Replace(v)); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = w.WriteString("\r\n")
+	return err
+}
+
+// h1HeaderFields returns the header lines of req, including the ones the
+// transport adds itself.
+//
+// The fields are arranged by the order the request asks for, or defaultOrder
+// if it doesn't, with the listed names in the listed casing, generated
+// headers included. Headers the order doesn't mention keep the order
+// net/http writes them in: Host, User-Agent, Connection, framing headers,
+// the request headers sorted by name and Accept-Encoding. Host stays first
+// unless the order mentions it.
+//
+// Connection: close is added for req.Close unless the request sets
+// Connection itself. User-Agent, Connection, Trailer and Accept-Encoding are
+// left out when the request holds the key without values. Host and the
+// framing headers can't be suppressed on HTTP/1.1.
+func h1HeaderFields(req *http.Request, host string, addGzipHeader bool, contentLength int64, chunked bool, defaultOrder []string) []headerField {
+	generated := make(map[string]string)
+	names := []string{"Host"}
+	generated["Host"] = host
+
+	userAgent := defaultUserAgent
+	if vv, ok := lookupHeader(req.Header, "User-Agent"); ok {
+		userAgent = ""
+		if len(vv) > 0 {
+			userAgent = vv[0]
+		}
+	}
+	if userAgent != "" {
+		names = append(names, "User-Agent")
+		generated["User-Agent"] = userAgent
+	}
+
+	// like net/http, but a Connection set by the caller is left alone
+	if _, ok := lookupHeader(req.Header, "Connection"); req.Close && !ok {
+		names = append(names, "Connection")
+		generated["Connection"] = "close"
+	}
+
+	if chunked {
+		names = append(names, "Transfer-Encoding")
+		generated["Transfer-Encoding"] = "chunked"
+	} else if shouldSendReqContentLength(req.Method, contentLength) {
+		names = append(names, "Content-Length")
+		generated["Content-Length"] = strconv.FormatInt(contentLength, 10)
+	}
+	if chunked && len(req.Trailer) > 0 && !suppressedHeader(req.Header, "Trailer") {
+		trailers := make([]string, 0, len(req.Trailer))
+		for k := range req.Trailer {
+			trailers = append(trailers, k)
+		}
+		sort.Strings(trailers)
+		names = append(names, "Trailer")
+		generated["Trailer"] = strings.Join(trailers, ",")
+	}
+
+	keys := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		if !h1ExcludeHeader(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	names = append(names, keys...)
+
+	if addGzipHeader && !suppressedHeader(req.Header, "Accept-Encoding") {
+		names = append(names, "Accept-Encoding")
+		generated["Accept-Encoding"] = "gzip"
+	}
+
+	order, ok := requestHeaderOrder(req)
+	if !ok {
+		order = defaultOrder
+	}
+	if order != nil && !mentionsHeader(order, "Host") {
+		order = append([]string{"Host"}, order...)
+	}
+
+	var fields []headerField
+	for _, name := range arrangeHeaders(order, names) {
+		canonical := http.CanonicalHeaderKey(name)
+		if value, ok := generated[canonical]; ok {
+			fields = append(fields, headerField{name, value})
+			continue
+		}
+		if h1ExcludeHeader(canonical) {
+			continue
+		}
+		values, _ := lookupHeader(req.Header, name)
+		for _, v := range values {
+			fields = append(fields, headerField{name, v})
+		}
+	}
+	return fields
+}
+
+// mentionsHeader reports whether order lists name, ignoring case.
+func mentionsHeader(order []string, name string) bool {
+	for _, key := range order {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// h1ExcludeHeader reports whether the request header named k is never
+// copied to the wire as is, because the transport writes it itself or it is
+// ordering metadata.
+func h1ExcludeHeader(k string) bool {
+	switch http.CanonicalHeaderKey(k) {
+	case "Host", "User-Agent", "Content-Length", "Transfer-Encoding", "Trailer",
+		HeaderOrderKey, PseudoHeaderOrderKey:
+		return true
+	}
+	return false
+}
+
+// lookupHeader returns the values stored under name, trying the exact key
+// before the canonical one.
+func lookupHeader(h http.Header, name string) ([]string, bool) {
+	if vv, ok := h[name]; ok {
+		return vv, true
+	}
+	vv, ok := h[http.CanonicalHeaderKey(name)]
+	return vv, ok
+}
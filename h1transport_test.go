@@ -0,0 +1,380 @@
+package httpmod
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitConnState waits until the server saw a connection go to state.
+func waitConnState(t *testing.T, states <-chan http.ConnState, state http.ConnState) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-states:
+			if s == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("connection never went %v", state)
+		}
+	}
+}
+
+// connStates returns a ConnState hook that passes the states on.
+func connStates() (func(net.Conn, http.ConnState), <-chan http.ConnState) {
+	states := make(chan http.ConnState, 100)
+	return func(c net.Conn, s http.ConnState) {
+		states <- s
+	}, states
+}
+
+func TestH1TransportCloseWhenIdle(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	hook, states := connStates()
+	server.Config.ConnState = hook
+	server.Start()
+	defer server.Close()
+
+	tr := &H1Transport{}
+	resp, err := tr.RoundTrip(mustRequest(t, "GET", server.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the request is still in flight, its connection goes once it is done
+	tr.closeWhenIdle()
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	waitConnState(t, states, http.StateClosed)
+	if len(tr.idle) != 0 {
+		t.Errorf("closed transport kept %d idle connections", len(tr.idle))
+	}
+}
+
+func TestH1TransportRejectsInvalidRequests(t *testing.T) {
+	dialed := false
+	tr := &H1Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			dialed = true
+			return nil, io.EOF
+		},
+	}
+
+	badMethod := mustRequest(t, "GET", "http://example.com/", nil)
+	badMethod.Method = "GET / HTTP/1.1\r\nX-Injected: 1\r\n"
+	badName := mustRequest(t, "GET", "http://example.com/", nil)
+	badName.Header["X-Foo\r\nX-Injected"] = []string{"1"}
+	badTrailer := mustRequest(t, "POST", "http://example.com/", ioutil.NopCloser(strings.NewReader("x")))
+	badTrailer.Trailer = http.Header{"Bad Name": nil}
+
+	for _, req := range []*http.Request{badMethod, badName, badTrailer} {
+		if _, err := tr.RoundTrip(req); err == nil || err == io.EOF {
+			t.Errorf("%q %v: got error %v, want an invalid request", req.Method, req.Header, err)
+		}
+	}
+	if dialed {
+		t.Error("invalid requests were sent")
+	}
+}
+
+func TestWriteH1RequestRejectsInvalidNames(t *testing.T) {
+	req := mustRequest(t, "GET", "http://example.com/", nil)
+	req.Header["X-Foo\r\nX-Injected"] = []string{"1"}
+
+	var buf strings.Builder
+	w := bufio.NewWriter(&buf)
+	if err := writeH1Request(w, req, false, nil, nil); err == nil {
+		t.Error("header name not valid on the wire was written")
+	}
+	w.Flush()
+	if buf.Len() != 0 {
+		t.Errorf("wrote %q before failing", buf.String())
+	}
+}
+
+// oneShotServer answers a single request per connection and then closes
+// it, so that every reused connection fails. It returns its address and the
+// bodies of the requests it answered.
+func oneShotServer(t *testing.T) (string, func() []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	var bodies []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				body, _ := ioutil.ReadAll(req.Body)
+				mu.Lock()
+				bodies = append(bodies, string(body))
+				mu.Unlock()
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}()
+		}
+	}()
+
+	return l.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), bodies...)
+	}
+}
+
+func TestH1TransportRetriesOnlyReplayableRequests(t *testing.T) {
+	tests := []struct {
+		method, body, idempotencyKey string
+		retried                      bool
+	}{
+		{"GET", "", "", true},
+		{"PUT", "", "", false},
+		{"POST", "hello", "", false},
+		{"POST", "hello", "abc", true},
+	}
+
+	for _, test := range tests {
+		addr, bodies := oneShotServer(t)
+		tr := &H1Transport{}
+
+		// leaves an idle connection the server has closed
+		resp, err := tr.RoundTrip(mustRequest(t, "GET", "http://"+addr+"/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var body io.Reader
+		if test.body != "" {
+			body = strings.NewReader(test.body)
+		}
+		req := mustRequest(t, test.method, "http://"+addr+"/", body)
+		if test.idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", test.idempotencyKey)
+		}
+		resp, err = tr.RoundTrip(req)
+		if test.retried {
+			if err != nil {
+				t.Errorf("%s with key %q: %v", test.method, test.idempotencyKey, err)
+				continue
+			}
+			resp.Body.Close()
+			if got := bodies(); len(got) != 2 || got[1] != test.body {
+				t.Errorf("%s with key %q: server got bodies %q", test.method, test.idempotencyKey, got)
+			}
+		} else if err == nil {
+			resp.Body.Close()
+			t.Errorf("%s with key %q was sent again", test.method, test.idempotencyKey)
+		}
+	}
+}
+
+func TestH1TransportExpectContinue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	var sent int64
+	tr := &H1Transport{
+		ExpectContinueTimeout: 5 * time.Second,
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return &countingConn{Conn: conn, written: &sent}, err
+		},
+	}
+
+	for _, path := range []string{"/echo", "/reject"} {
+		body := strings.Repeat("x", 1<<20)
+		req := mustRequest(t, "POST", server.URL+path, strings.NewReader(body))
+		req.Header.Set("Expect", "100-continue")
+
+		sent = 0
+		start := time.Now()
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("%s: waited for the timeout instead of the server", path)
+		}
+
+		switch path {
+		case "/echo":
+			if string(got) != body {
+				t.Errorf("%s: got %d bytes back, want %d", path, len(got), len(body))
+			}
+		case "/reject":
+			if resp.StatusCode != http.StatusExpectationFailed {
+				t.Errorf("%s: status %d", path, resp.StatusCode)
+			}
+			if sent >= int64(len(body)) {
+				t.Errorf("%s: the body was sent anyway", path)
+			}
+		}
+	}
+}
+
+// countingConn counts the bytes written to it.
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	*c.written += int64(n)
+	return n, err
+}
+
+func TestH1TransportIdleConnTimeout(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	hook, states := connStates()
+	server.Config.ConnState = hook
+	server.Start()
+	defer server.Close()
+
+	tr := &H1Transport{IdleConnTimeout: 50 * time.Millisecond}
+	resp, err := tr.RoundTrip(mustRequest(t, "GET", server.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	waitConnState(t, states, http.StateClosed)
+}
+
+func TestH1TransportCancelledRequestNotRetried(t *testing.T) {
+	addr, bodies := oneShotServer(t)
+	tr := &H1Transport{}
+
+	resp, err := tr.RoundTrip(mustRequest(t, "GET", "http://"+addr+"/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := mustRequest(t, "GET", "http://"+addr+"/", nil).WithContext(ctx)
+	if _, err := tr.RoundTrip(req); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if got := bodies(); len(got) != 1 {
+		t.Errorf("server answered %d requests, want 1", len(got))
+	}
+}
+
+func mustRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestH1HeaderFieldsGeneratedHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   []string
+		header  http.Header
+		chunked bool
+		trailer http.Header
+		fields  string
+	}{
+		{
+			name:   "no order",
+			header: http.Header{"X-B": {"b"}, "X-A": {"a"}},
+			fields: "Host,User-Agent,Content-Length,X-A,X-B,Accept-Encoding",
+		},
+		{
+			name:   "generated listed",
+			order:  []string{"accept-encoding", "X-B", "content-length", "Host"},
+			header: http.Header{"X-B": {"b"}, "X-A": {"a"}},
+			fields: "accept-encoding,X-B,content-length,Host,User-Agent,X-A",
+		},
+		{
+			name:   "unlisted in between",
+			order:  []string{"X-B", UnlistedHeaders, "User-Agent"},
+			header: http.Header{"X-B": {"b"}, "X-A": {"a"}},
+			fields: "Host,X-B,Content-Length,X-A,Accept-Encoding,User-Agent",
+		},
+		{
+			name:   "suppressed",
+			header: http.Header{"X-A": {"a"}, "User-Agent": nil, "Accept-Encoding": nil},
+			fields: "Host,Content-Length,X-A",
+		},
+		{
+			// framing headers go out no matter what
+			name:   "framing not suppressed",
+			header: http.Header{"X-A": {"a"}, "Content-Length": nil, "Host": nil},
+			fields: "Host,User-Agent,Content-Length,X-A,Accept-Encoding",
+		},
+		{
+			name:    "trailer",
+			order:   []string{"Trailer", "X-A"},
+			header:  http.Header{"X-A": {"a"}},
+			chunked: true,
+			trailer: http.Header{"X-T": nil},
+			fields:  "Host,Trailer,X-A,User-Agent,Transfer-Encoding,Accept-Encoding",
+		},
+		{
+			name:    "trailer suppressed",
+			header:  http.Header{"X-A": {"a"}, "Trailer": nil},
+			chunked: true,
+			trailer: http.Header{"X-T": nil},
+			fields:  "Host,User-Agent,Transfer-Encoding,X-A,Accept-Encoding",
+		},
+	}
+
+	for _, test := range tests {
+		req := mustRequest(t, "POST", "http://example.com/", strings.NewReader("body"))
+		req.Header = test.header
+		req.Trailer = test.trailer
+		contentLength := int64(4)
+		if test.chunked {
+			contentLength = -1
+		}
+
+		var names []string
+		for _, field := range h1HeaderFields(req, "example.com", true, contentLength, test.chunked, test.order) {
+			names = append(names, field.name)
+		}
+		if got := strings.Join(names, ","); got != test.fields {
+			t.Errorf("%s: wrote %s, want %s", test.name, got, test.fields)
+		}
+	}
+}
@@ -0,0 +1,1317 @@
+package httpmod
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+var (
+	errH2ConnUnusable       = errors.New("http2: client conn not usable")
+	errH2ConnClosed         = errors.New("http2: client conn is closed")
+	errH2StreamClosed       = errors.New("http2: stream closed")
+	errH2ResponseBodyClosed = errors.New("http2: response body closed")
+	errH2GotGoAway          = errors.New("http2: server sent GOAWAY and closed the connection")
+	errH2StreamUnprocessed  = errors.New("http2: server sent GOAWAY before processing the stream")
+)
+
+// H2Transport is an HTTP/2 client transport that presents the fingerprint
+// described by its Settings. Unlike an http2.Transport it does not depend on
+// Apply, all framing, HPACK and flow control is done here.
+type H2Transport struct {
+	// DialTLS dials a connection to addr that has negotiated h2. If nil,
+	// crypto/tls is used.
+	DialTLS func(network, addr string) (net.Conn, error)
+
+	// Settings describes the connection preface and header encoding. Nil
+	// means DefaultH2Settings at the time a connection is opened.
+	Settings *H2Settings
+
+	// DisableCompression stops the transport from asking for gzip when the
+	// request doesn't set Accept-Encoding itself.
+	DisableCompression bool
+
+	// ReadIdleTimeout is how long a connection may go without receiving a
+	// frame before it is checked with a PING. Zero disables the check.
+	ReadIdleTimeout time.Duration
+
+	// PingTimeout is how long the answer to that PING may take before the
+	// connection is closed. Zero means 15 seconds.
+	PingTimeout time.Duration
+
+	// IdleConnTimeout closes connections that had no streams for that
+	// long. Zero means no limit.
+	IdleConnTimeout time.Duration
+
+	mu      sync.Mutex
+	conns   map[string][]*h2ClientConn // keyed by host:port
+	dialing map[string]*h2DialCall     // in flight dials, keyed by host:port
+
+	// closed is set by closeWhenIdle, connections are closed once their
+	// last stream is done; atomic
+	closed int32
+}
+
+// h2DialCall is a dial that concurrent requests to the same address wait on
+// instead of all dialing themselves.
+type h2DialCall struct {
+	done chan struct{}
+	cc   *h2ClientConn
+	err  error
+}
+
+func (t *H2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		closeReqBody(req)
+		return nil, errors.New("http2: nil Request.URL")
+	}
+	if req.URL.Scheme != "https" {
+		closeReqBody(req)
+		return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
+	}
+	addr, err := addrForDial(req.URL)
+	if err != nil {
+		closeReqBody(req)
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		cc, err := t.getConn(addr)
+		if err != nil {
+			closeReqBody(req)
+			return nil, err
+		}
+		res, err := cc.roundTrip(req)
+		// nothing has been sent when the conn turns out to be unusable,
+		// so it's safe to try again on a different one
+		if err == errH2ConnUnusable {
+			if attempt < 3 {
+				continue
+			}
+			closeReqBody(req)
+		}
+		// the server says it never processed the stream, so the request
+		// can go again on a new conn if its body can be sent again
+		if err == errH2StreamUnprocessed && attempt < 3 {
+			if newReq, rerr := rewindBody(req); rerr == nil {
+				req = newReq
+				continue
+			}
+		}
+		return res, err
+	}
+}
+
+// CloseIdleConnections closes connections that have no requests in flight.
+func (t *H2Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	var idle []*h2ClientConn
+	for addr, conns := range t.conns {
+		var kept []*h2ClientConn
+		for _, cc := range conns {
+			cc.mu.Lock()
+			if len(cc.streams) == 0 {
+				// a request that got cc from getConn before this
+				// finds it unusable and tries another one
+				cc.closed = true
+				idle = append(idle, cc)
+			} else {
+				kept = append(kept, cc)
+			}
+			cc.mu.Unlock()
+		}
+		if len(kept) == 0 {
+			delete(t.conns, addr)
+		} else {
+			t.conns[addr] = kept
+		}
+	}
+	t.mu.Unlock()
+
+	for _, cc := range idle {
+		cc.tconn.Close()
+	}
+}
+
+// closeWhenIdle closes the idle connections, and the ones in use once their
+// last stream is done.
+func (t *H2Transport) closeWhenIdle() {
+	atomic.StoreInt32(&t.closed, 1)
+	t.CloseIdleConnections()
+}
+
+// getConn returns a pooled connection to addr that can take another
+// request, or dials a new one.
+func (t *H2Transport) getConn(addr string) (*h2ClientConn, error) {
+	t.mu.Lock()
+	for _, cc := range t.conns[addr] {
+		if cc.canTakeNewRequest() {
+			t.mu.Unlock()
+			return cc, nil
+		}
+	}
+
+	call, ok := t.dialing[addr]
+	if !ok {
+		call = &h2DialCall{done: make(chan struct{})}
+		if t.dialing == nil {
+			t.dialing = make(map[string]*h2DialCall)
+		}
+		t.dialing[addr] = call
+		go t.dialConn(addr, call)
+	}
+	t.mu.Unlock()
+
+	<-call.done
+	return call.cc, call.err
+}
+
+func (t *H2Transport) dialConn(addr string, call *h2DialCall) {
+	conn, err := t.dial("tcp", addr)
+	if err == nil {
+		call.cc, call.err = t.newClientConn(conn, addr)
+	} else {
+		call.err = err
+	}
+
+	t.mu.Lock()
+	delete(t.dialing, addr)
+	if call.err == nil {
+		if t.conns == nil {
+			t.conns = make(map[string][]*h2ClientConn)
+		}
+		t.conns[addr] = append(t.conns[addr], call.cc)
+	}
+	t.mu.Unlock()
+
+	close(call.done)
+}
+
+// removeConn drops cc from the pool.
+func (t *H2Transport) removeConn(cc *h2ClientConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conns := t.conns[cc.addr]
+	for i, pooled := range conns {
+		if pooled == cc {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(t.conns, cc.addr)
+		return
+	}
+	t.conns[cc.addr] = conns
+}
+
+func (t *H2Transport) dial(network, addr string) (net.Conn, error) {
+	if t.DialTLS != nil {
+		return t.DialTLS(network, addr)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.Dial(network, addr, &tls.Config{
+		ServerName: host,
+		NextProtos: []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p := conn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("http2: unexpected ALPN protocol %q; want %q", p, http2.NextProtoTLS)
+	}
+	return conn, nil
+}
+
+// h2ClientConn is a single HTTP/2 connection opened by an H2Transport.
+type h2ClientConn struct {
+	t        *H2Transport
+	addr     string
+	settings *H2Settings
+	tconn    net.Conn
+	tlsState *tls.ConnectionState // nil if tconn doesn't use crypto/tls
+
+	bw   *bufio.Writer
+	br   *bufio.Reader
+	fr   *http2.Framer
+	hbuf bytes.Buffer // HPACK encoder writes into this
+	henc *hpackEncoder
+
+	wmu  sync.Mutex // held while writing; acquire BEFORE mu if holding both
+	werr error      // first write error that has occurred
+
+	readerDone chan struct{} // closed once the read loop is done
+	idleTimer  *time.Timer   // nil without an IdleConnTimeout
+
+	mu           sync.Mutex // guards following
+	cond         *sync.Cond // hold mu; broadcast on flow/closed changes
+	closed       bool
+	pings        map[[8]byte]chan struct{} // in flight pings, closed on ack
+	goAway       *http2.GoAwayFrame        // if non-nil, the GoAwayFrame we received
+	streams      map[uint32]*h2Stream
+	nextStreamID uint32
+	flow         int32 // bytes we may still send on the connection
+	inflow       int32 // bytes the peer may still send on the connection
+	inflowTarget int32 // connection receive window we keep topping up to
+	streamInflow int32 // receive window we advertised for each stream
+	// Settings from peer: (also guarded by mu)
+	maxFrameSize          uint32
+	maxConcurrentStreams  uint32
+	peerMaxHeaderListSize uint64
+	initialWindowSize     int32
+}
+
+func (t *H2Transport) newClientConn(c net.Conn, addr string) (*h2ClientConn, error) {
+	settings := t.Settings
+	if settings == nil {
+		settings = DefaultH2Settings()
+	}
+
+	cc := &h2ClientConn{
+		t:                     t,
+		addr:                  addr,
+		settings:              settings,
+		tconn:                 c,
+		streams:               make(map[uint32]*h2Stream),
+		nextStreamID:          1,
+		flow:                  int32(settings.InitialWindowSize),
+		streamInflow:          int32(settings.settingValue(http2.SettingInitialWindowSize, 65535)),
+		maxFrameSize:          16 << 10, // spec default
+		maxConcurrentStreams:  100,      // until the peer tells us otherwise
+		peerMaxHeaderListSize: 0xffffffffffffffff,
+		initialWindowSize:     65535, // spec default
+		readerDone:            make(chan struct{}),
+		pings:                 make(map[[8]byte]chan struct{}),
+	}
+	cc.cond = sync.NewCond(&cc.mu)
+	if d := t.IdleConnTimeout; d != 0 {
+		cc.idleTimer = time.AfterFunc(d, cc.onIdleTimeout)
+	}
+
+	cc.bw = bufio.NewWriter(stickyErrWriter{c, &cc.werr})
+	cc.br = bufio.NewReader(c)
+	cc.fr = http2.NewFramer(cc.bw, cc.br)
+	cc.fr.ReadMetaHeaders = hpack.NewDecoder(settings.settingValue(http2.SettingHeaderTableSize, 4096), nil)
+	cc.fr.MaxHeaderListSize = settings.settingValue(http2.SettingMaxHeaderListSize, 0)
+
+	cc.henc = newHPACKEncoder(&cc.hbuf, settings)
+
+	if cs, ok := c.(connectionStater); ok {
+		state := cs.ConnectionState()
+		cc.tlsState = &state
+	}
+
+	connWindow := writeClientPreface(cc.bw, cc.fr, settings, &cc.nextStreamID)
+	cc.inflow = int32(connWindow)
+	cc.inflowTarget = cc.inflow
+	cc.bw.Flush()
+	if cc.werr != nil {
+		if cc.idleTimer != nil {
+			cc.idleTimer.Stop()
+		}
+		c.Close()
+		return nil, cc.werr
+	}
+
+	go cc.readLoop()
+	return cc, nil
+}
+
+// onIdleTimeout closes the connection if it still has no streams.
+func (cc *h2ClientConn) onIdleTimeout() {
+	cc.mu.Lock()
+	if len(cc.streams) > 0 || cc.closed {
+		cc.mu.Unlock()
+		return
+	}
+	// don't hand it out anymore, the read loop cleans up
+	cc.closed = true
+	cc.mu.Unlock()
+
+	cc.tconn.Close()
+}
+
+func (cc *h2ClientConn) canTakeNewRequest() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return cc.canTakeNewRequestLocked()
+}
+
+func (cc *h2ClientConn) canTakeNewRequestLocked() bool {
+	return !cc.closed && cc.goAway == nil &&
+		uint32(len(cc.streams)) < cc.maxConcurrentStreams &&
+		cc.nextStreamID < math.MaxInt32
+}
+
+// roundTrip sends req on cc. Unless it returns errH2ConnUnusable, the body
+// of req is closed or handed to the stream.
+func (cc *h2ClientConn) roundTrip(req *http.Request) (*http.Response, error) {
+	trailers, err := commaSeparatedTrailers(req)
+	if err != nil {
+		closeReqBody(req)
+		return nil, err
+	}
+	contentLength := actualContentLength(req)
+	hasBody := contentLength != 0
+
+	// Ask for gzip like the stdlib does, and decompress transparently.
+	requestedGzip := !cc.t.DisableCompression &&
+		req.Header.Get("Accept-Encoding") == "" &&
+		req.Header.Get("Range") == "" &&
+		req.Method != "HEAD"
+
+	// The HPACK state changes while encoding, so the block has to go out
+	// before any other one, and stream IDs have to go out in order. Both
+	// happen under wmu, mu is only held to allocate the stream so the read
+	// loop isn't held up by the write.
+	cc.wmu.Lock()
+	cc.mu.Lock()
+	if !cc.canTakeNewRequestLocked() {
+		cc.mu.Unlock()
+		cc.wmu.Unlock()
+		return nil, errH2ConnUnusable
+	}
+	cs := cc.newStream(req, requestedGzip)
+	maxFrameSize, peerMaxHeaderListSize := int(cc.maxFrameSize), cc.peerMaxHeaderListSize
+	cc.mu.Unlock()
+
+	cc.hbuf.Reset()
+	err = encodeRequestHeaders(req, cc.settings, requestedGzip, trailers, contentLength, peerMaxHeaderListSize, func(name, value string) {
+		cc.henc.WriteField(name, value)
+	})
+	if err != nil {
+		cc.wmu.Unlock()
+		// the stream ID is skipped, which the peer takes as closed
+		cc.mu.Lock()
+		cc.forgetStream(cs)
+		cc.mu.Unlock()
+		closeReqBody(req)
+		return nil, err
+	}
+
+	endStream := !hasBody && trailers == ""
+	writeHeaderBlock(cc.fr, cs.ID, endStream, maxFrameSize, headersPriority(req, cc.settings), cc.hbuf.Bytes())
+	cc.bw.Flush()
+	werr := cc.werr
+	cc.wmu.Unlock()
+
+	if werr != nil {
+		cc.tconn.Close()
+		closeReqBody(req)
+		// a GOAWAY may have come in while writing, the request can go
+		// again then
+		select {
+		case re := <-cs.resc:
+			if re.err == errH2StreamUnprocessed {
+				return nil, re.err
+			}
+		default:
+		}
+		return nil, werr
+	}
+
+	if !endStream {
+		go cs.writeRequestBody(req.Body, trailers != "")
+	} else {
+		closeReqBody(req)
+	}
+
+	ctx := req.Context()
+	select {
+	case re := <-cs.resc:
+		if re.err != nil {
+			return nil, re.err
+		}
+		if ctx.Done() != nil {
+			go func() {
+				select {
+				case <-ctx.Done():
+					cs.abort(ctx.Err(), true)
+				case <-cs.done:
+				}
+			}()
+		}
+		return re.res, nil
+	case <-ctx.Done():
+		cs.abort(ctx.Err(), true)
+		return nil, ctx.Err()
+	}
+}
+
+// newStream allocates the next stream. cc.mu must be held.
+func (cc *h2ClientConn) newStream(req *http.Request, requestedGzip bool) *h2Stream {
+	cs := &h2Stream{
+		cc:            cc,
+		req:           req,
+		ID:            cc.nextStreamID,
+		resc:          make(chan resAndError, 1),
+		requestedGzip: requestedGzip,
+		flow:          cc.initialWindowSize,
+		inflow:        cc.streamInflow,
+		done:          make(chan struct{}),
+	}
+	cs.body.c.L = &cs.body.mu
+	cc.nextStreamID += 2
+	cc.streams[cs.ID] = cs
+	if cc.idleTimer != nil {
+		cc.idleTimer.Stop()
+	}
+	return cs
+}
+
+// forgetStream removes cs from the connection. cc.mu must be held.
+func (cc *h2ClientConn) forgetStream(cs *h2Stream) {
+	if _, ok := cc.streams[cs.ID]; !ok {
+		return
+	}
+	delete(cc.streams, cs.ID)
+	close(cs.done)
+	if cs.stopReqBody == nil {
+		cs.stopReqBody = errH2StreamClosed
+	}
+	cc.cond.Broadcast()
+
+	// nothing else is coming after a GOAWAY or on a transport that was
+	// closed, don't keep the conn around
+	if len(cc.streams) == 0 && (cc.goAway != nil || atomic.LoadInt32(&cc.t.closed) != 0) {
+		cc.tconn.Close()
+	}
+	if len(cc.streams) == 0 && cc.idleTimer != nil && !cc.closed {
+		cc.idleTimer.Reset(cc.t.IdleConnTimeout)
+	}
+}
+
+func (cc *h2ClientConn) streamByID(id uint32) *h2Stream {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return cc.streams[id]
+}
+
+// writeFrames runs write with cc.wmu held and flushes afterwards.
+func (cc *h2ClientConn) writeFrames(write func(fr *http2.Framer)) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	write(cc.fr)
+	cc.bw.Flush()
+	return cc.werr
+}
+
+func (cc *h2ClientConn) writeStreamReset(streamID uint32, code http2.ErrCode) {
+	cc.writeFrames(func(fr *http2.Framer) {
+		fr.WriteRSTStream(streamID, code)
+	})
+}
+
+func (cc *h2ClientConn) readLoop() {
+	defer close(cc.readerDone)
+
+	err := cc.readFrames()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	cc.mu.Lock()
+	cc.closed = true
+	if cc.idleTimer != nil {
+		cc.idleTimer.Stop()
+	}
+	if cc.goAway != nil {
+		err = errH2GotGoAway
+	}
+	for _, cs := range cc.streams {
+		cs.abortLocked(err)
+	}
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	cc.tconn.Close()
+	cc.t.removeConn(cc)
+}
+
+func (cc *h2ClientConn) readFrames() error {
+	// ping the peer whenever it has been quiet for ReadIdleTimeout
+	var healthCheck *time.Timer
+	if d := cc.t.ReadIdleTimeout; d != 0 {
+		healthCheck = time.AfterFunc(d, cc.healthCheck)
+		defer healthCheck.Stop()
+	}
+	for {
+		f, err := cc.fr.ReadFrame()
+		if healthCheck != nil {
+			healthCheck.Reset(cc.t.ReadIdleTimeout)
+		}
+		if se, ok := err.(http2.StreamError); ok {
+			if cs := cc.streamByID(se.StreamID); cs != nil {
+				cs.abort(se, false)
+			}
+			cc.writeStreamReset(se.StreamID, se.Code)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			err = cc.processHeaders(f)
+		case *http2.DataFrame:
+			err = cc.processData(f)
+		case *http2.GoAwayFrame:
+			cc.processGoAway(f)
+		case *http2.RSTStreamFrame:
+			cc.processResetStream(f)
+		case *http2.SettingsFrame:
+			err = cc.processSettings(f)
+		case *http2.PushPromiseFrame:
+			// we never want pushes, even when advertising otherwise
+			err = cc.writeFrames(func(fr *http2.Framer) {
+				fr.WriteRSTStream(f.PromiseID, http2.ErrCodeRefusedStream)
+			})
+		case *http2.WindowUpdateFrame:
+			err = cc.processWindowUpdate(f)
+		case *http2.PingFrame:
+			if f.IsAck() {
+				cc.processPingAck(f)
+			} else {
+				err = cc.writeFrames(func(fr *http2.Framer) {
+					fr.WritePing(true, f.Data)
+				})
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// healthCheck pings the peer and closes the connection if the answer
+// doesn't come within PingTimeout.
+func (cc *h2ClientConn) healthCheck() {
+	timeout := cc.t.PingTimeout
+	if timeout == 0 {
+		timeout = 15 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := cc.ping(ctx); err != nil {
+		cc.tconn.Close()
+	}
+}
+
+// ping sends a PING and waits for the answer.
+func (cc *h2ClientConn) ping(ctx context.Context) error {
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return err
+	}
+	c := make(chan struct{})
+	cc.mu.Lock()
+	cc.pings[data] = c
+	cc.mu.Unlock()
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.pings, data)
+		cc.mu.Unlock()
+	}()
+
+	err := cc.writeFrames(func(fr *http2.Framer) {
+		fr.WritePing(false, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cc.readerDone:
+		return errH2ConnClosed
+	}
+}
+
+func (cc *h2ClientConn) processPingAck(f *http2.PingFrame) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if c, ok := cc.pings[f.Data]; ok {
+		close(c)
+		delete(cc.pings, f.Data)
+	}
+}
+
+func (cc *h2ClientConn) processHeaders(f *http2.MetaHeadersFrame) error {
+	cs := cc.streamByID(f.StreamID)
+	if cs == nil {
+		// we already gave up on this stream
+		return nil
+	}
+
+	if cs.pastHeaders {
+		if !f.StreamEnded() {
+			cs.abort(http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeProtocol}, true)
+			return nil
+		}
+		cs.processTrailers(f)
+		return nil
+	}
+
+	if f.Truncated {
+		cs.abort(errors.New("http2: response header list larger than advertised limit"), true)
+		return nil
+	}
+
+	status := f.PseudoValue("status")
+	statusCode, err := strconv.Atoi(status)
+	if err != nil || statusCode < 100 {
+		cs.abort(errors.New("http2: malformed response from server: malformed non-numeric status pseudo header"), true)
+		return nil
+	}
+	if statusCode < 200 {
+		// informational responses aren't passed on
+		if f.StreamEnded() {
+			cs.abort(errors.New("http2: 1xx informational response with END_STREAM flag"), true)
+		}
+		return nil
+	}
+
+	header := make(http.Header)
+	res := &http.Response{
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     header,
+		StatusCode: statusCode,
+		Status:     status + " " + http.StatusText(statusCode),
+		Request:    cs.req,
+		TLS:        cc.tlsState,
+	}
+	for _, hf := range f.RegularFields() {
+		key := http.CanonicalHeaderKey(hf.Name)
+		if key == "Trailer" {
+			if res.Trailer == nil {
+				res.Trailer = make(http.Header)
+			}
+			for _, name := range strings.Split(hf.Value, ",") {
+				name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+				if name != "" {
+					res.Trailer[name] = nil
+				}
+			}
+			continue
+		}
+		header[key] = append(header[key], hf.Value)
+	}
+
+	streamEnded := f.StreamEnded()
+	isHead := cs.req.Method == "HEAD"
+	if !streamEnded || isHead {
+		res.ContentLength = -1
+		if clens := header["Content-Length"]; len(clens) == 1 {
+			if cl, err := strconv.ParseInt(clens[0], 10, 64); err == nil && cl >= 0 {
+				res.ContentLength = cl
+			}
+		}
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cs.pastHeaders = true
+	cs.resTrailer = &res.Trailer
+	if streamEnded || isHead {
+		res.Body = http.NoBody
+		if streamEnded {
+			cc.forgetStream(cs)
+		} else {
+			// nobody reads what comes after the headers of a HEAD
+			// response, DATA the peer sends anyway gets its window
+			// handed back right away
+			cs.body.CloseWithError(io.EOF)
+		}
+	} else {
+		res.Body = h2ResponseBody{cs}
+		if cs.requestedGzip && header.Get("Content-Encoding") == "gzip" {
+			header.Del("Content-Encoding")
+			header.Del("Content-Length")
+			res.ContentLength = -1
+			res.Body = &gzipReader{body: res.Body}
+			res.Uncompressed = true
+		}
+	}
+	cs.deliverLocked(res, nil)
+	return nil
+}
+
+func (cc *h2ClientConn) processData(f *http2.DataFrame) error {
+	cs := cc.streamByID(f.StreamID)
+	if cs == nil {
+		cc.mu.Lock()
+		neverOpened := f.StreamID >= cc.nextStreamID
+		cc.mu.Unlock()
+		if neverOpened {
+			return http2.ConnectionError(http2.ErrCodeProtocol)
+		}
+
+		// hand the connection level window back, nobody reads this
+		if f.Length > 0 {
+			return cc.writeFrames(func(fr *http2.Framer) {
+				fr.WriteWindowUpdate(0, f.Length)
+			})
+		}
+		return nil
+	}
+	if !cs.pastHeaders {
+		cs.abort(http2.StreamError{StreamID: f.StreamID, Code: http2.ErrCodeProtocol}, true)
+		return nil
+	}
+
+	if f.Length > 0 {
+		data := f.Data()
+
+		cc.mu.Lock()
+		if int32(f.Length) > cc.inflow || int32(f.Length) > cs.inflow {
+			cc.mu.Unlock()
+			return http2.ConnectionError(http2.ErrCodeFlowControl)
+		}
+		cc.inflow -= int32(f.Length)
+		cs.inflow -= int32(f.Length)
+		cc.mu.Unlock()
+
+		// padding never reaches the reader, return it right away
+		refund := f.Length - uint32(len(data))
+		if len(data) > 0 {
+			if _, err := cs.body.Write(data); err != nil {
+				refund += uint32(len(data))
+			}
+		}
+		if refund > 0 {
+			cc.mu.Lock()
+			cc.inflow += int32(refund)
+			cs.inflow += int32(refund)
+			cc.mu.Unlock()
+
+			err := cc.writeFrames(func(fr *http2.Framer) {
+				fr.WriteWindowUpdate(0, refund)
+				if !f.StreamEnded() {
+					fr.WriteWindowUpdate(cs.ID, refund)
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if f.StreamEnded() {
+		cs.body.CloseWithError(io.EOF)
+
+		cc.mu.Lock()
+		cc.forgetStream(cs)
+		cc.mu.Unlock()
+	}
+	return nil
+}
+
+func (cc *h2ClientConn) processGoAway(f *http2.GoAwayFrame) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.goAway = f
+	// the peer never looked at these, RoundTrip sends them again
+	for id, cs := range cc.streams {
+		if id > f.LastStreamID {
+			cs.abortLocked(errH2StreamUnprocessed)
+		}
+	}
+	if len(cc.streams) == 0 {
+		cc.tconn.Close()
+	}
+}
+
+func (cc *h2ClientConn) processResetStream(f *http2.RSTStreamFrame) {
+	cs := cc.streamByID(f.StreamID)
+	if cs == nil {
+		return
+	}
+	cs.abort(http2.StreamError{StreamID: f.StreamID, Code: f.ErrCode}, false)
+}
+
+func (cc *h2ClientConn) processSettings(f *http2.SettingsFrame) error {
+	if f.IsAck() {
+		return nil
+	}
+
+	var headerTableSize *uint32
+	cc.mu.Lock()
+	err := f.ForeachSetting(func(s http2.Setting) error {
+		switch s.ID {
+		case http2.SettingMaxFrameSize:
+			cc.maxFrameSize = s.Val
+		case http2.SettingMaxConcurrentStreams:
+			cc.maxConcurrentStreams = s.Val
+		case http2.SettingMaxHeaderListSize:
+			cc.peerMaxHeaderListSize = uint64(s.Val)
+		case http2.SettingInitialWindowSize:
+			if s.Val > math.MaxInt32 {
+				return http2.ConnectionError(http2.ErrCodeFlowControl)
+			}
+			// the change applies to streams that are already open
+			delta := int32(s.Val) - cc.initialWindowSize
+			for _, cs := range cc.streams {
+				cs.flow += delta
+			}
+			cc.initialWindowSize = int32(s.Val)
+			cc.cond.Broadcast()
+		case http2.SettingHeaderTableSize:
+			val := s.Val
+			headerTableSize = &val
+		}
+		return nil
+	})
+	cc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return cc.writeFrames(func(fr *http2.Framer) {
+		if headerTableSize != nil {
+			cc.henc.SetMaxDynamicTableSizeLimit(*headerTableSize)
+		}
+		fr.WriteSettingsAck()
+	})
+}
+
+func (cc *h2ClientConn) processWindowUpdate(f *http2.WindowUpdateFrame) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if f.StreamID == 0 {
+		if !addFlow(&cc.flow, f.Increment) {
+			return http2.ConnectionError(http2.ErrCodeFlowControl)
+		}
+	} else if cs := cc.streams[f.StreamID]; cs != nil {
+		if !addFlow(&cs.flow, f.Increment) {
+			return http2.ConnectionError(http2.ErrCodeFlowControl)
+		}
+	}
+	cc.cond.Broadcast()
+	return nil
+}
+
+// addFlow adds n to the window at f, reporting false if that overflows.
+func addFlow(f *int32, n uint32) bool {
+	sum := int64(*f) + int64(n)
+	if sum > math.MaxInt32 {
+		return false
+	}
+	*f = int32(sum)
+	return true
+}
+
+// h2Stream is a single request on an h2ClientConn.
+type h2Stream struct {
+	cc            *h2ClientConn
+	req           *http.Request
+	ID            uint32
+	resc          chan resAndError
+	requestedGzip bool
+	body          bodyPipe // response payload
+
+	delivered   bool  // resc has been sent on; guarded by cc.mu
+	flow        int32 // guarded by cc.mu
+	inflow      int32 // guarded by cc.mu
+	stopReqBody error // if non-nil, stop writing req body; guarded by cc.mu
+
+	done chan struct{} // closed when stream remove from cc.streams map; close calls guarded by cc.mu
+
+	// owned by readLoop:
+	pastHeaders bool
+	resTrailer  *http.Header // client's Response.Trailer
+}
+
+// deliverLocked passes the outcome of the request to roundTrip, once.
+// cc.mu must be held.
+func (cs *h2Stream) deliverLocked(res *http.Response, err error) {
+	if cs.delivered {
+		return
+	}
+	cs.delivered = true
+	cs.resc <- resAndError{res: res, err: err}
+}
+
+// abort fails the stream with err and resets it on the wire if sendReset is
+// set.
+func (cs *h2Stream) abort(err error, sendReset bool) {
+	cc := cs.cc
+	cc.mu.Lock()
+	_, active := cc.streams[cs.ID]
+	cs.abortLocked(err)
+	cc.mu.Unlock()
+
+	if active && sendReset {
+		cc.writeStreamReset(cs.ID, http2.ErrCodeCancel)
+	}
+}
+
+// abortLocked is abort without the reset. cc.mu must be held.
+func (cs *h2Stream) abortLocked(err error) {
+	cs.stopReqBody = err
+	cs.deliverLocked(nil, err)
+	cs.body.CloseWithError(err)
+	cs.cc.forgetStream(cs)
+}
+
+func (cs *h2Stream) processTrailers(f *http2.MetaHeadersFrame) {
+	trailer := make(http.Header)
+	for _, hf := range f.RegularFields() {
+		key := http.CanonicalHeaderKey(hf.Name)
+		trailer[key] = append(trailer[key], hf.Value)
+	}
+
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	*cs.resTrailer = trailer
+	cs.body.CloseWithError(io.EOF)
+	cc.forgetStream(cs)
+}
+
+// writeRequestBody sends body in DATA frames as the flow control windows
+// allow, followed by the request trailers if there are any.
+func (cs *h2Stream) writeRequestBody(body io.ReadCloser, hasTrailers bool) {
+	cc := cs.cc
+	if body != nil {
+		defer body.Close()
+	} else {
+		body = http.NoBody
+	}
+
+	buf := make([]byte, 16<<10)
+	for sawEOF := false; !sawEOF; {
+		n, err := body.Read(buf)
+		if err == io.EOF {
+			sawEOF = true
+		} else if err != nil {
+			cs.abort(err, true)
+			return
+		}
+
+		remain := buf[:n]
+		for len(remain) > 0 {
+			allowed, err := cs.awaitFlowControl(len(remain))
+			if err != nil {
+				return
+			}
+			data := remain[:allowed]
+			remain = remain[allowed:]
+
+			endStream := sawEOF && len(remain) == 0 && !hasTrailers
+			err = cc.writeFrames(func(fr *http2.Framer) {
+				fr.WriteData(cs.ID, endStream, data)
+			})
+			if err != nil {
+				cc.tconn.Close()
+				return
+			}
+			if endStream {
+				return
+			}
+		}
+	}
+
+	var err error
+	if hasTrailers {
+		cc.wmu.Lock()
+		cc.hbuf.Reset()
+		for k, vv := range cs.req.Trailer {
+			lowKey := strings.ToLower(k)
+			for _, v := range vv {
+				cc.henc.WriteField(lowKey, v)
+			}
+		}
+		writeHeaderBlock(cc.fr, cs.ID, true, int(cc.maxFrameSizeSnapshot()), http2.PriorityParam{}, cc.hbuf.Bytes())
+		cc.bw.Flush()
+		err = cc.werr
+		cc.wmu.Unlock()
+	} else {
+		err = cc.writeFrames(func(fr *http2.Framer) {
+			fr.WriteData(cs.ID, true, nil)
+		})
+	}
+	if err != nil {
+		cc.tconn.Close()
+	}
+}
+
+// awaitFlowControl waits until at least one byte may be sent on the stream
+// and reserves up to maxBytes of it.
+func (cs *h2Stream) awaitFlowControl(maxBytes int) (int, error) {
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for {
+		if cc.closed {
+			return 0, errH2ConnClosed
+		}
+		if cs.stopReqBody != nil {
+			return 0, cs.stopReqBody
+		}
+
+		take := cs.flow
+		if cc.flow < take {
+			take = cc.flow
+		}
+		if int32(cc.maxFrameSize) < take {
+			take = int32(cc.maxFrameSize)
+		}
+		if int32(maxBytes) < take {
+			take = int32(maxBytes)
+		}
+		if take > 0 {
+			cs.flow -= take
+			cc.flow -= take
+			return int(take), nil
+		}
+		cc.cond.Wait()
+	}
+}
+
+func (cc *h2ClientConn) maxFrameSizeSnapshot() uint32 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return cc.maxFrameSize
+}
+
+// h2ResponseBody is the Response.Body of a request made on an
+// h2ClientConn. Reading it hands the flow control window back to the peer.
+type h2ResponseBody struct {
+	cs *h2Stream
+}
+
+func (b h2ResponseBody) Read(p []byte) (int, error) {
+	cs := b.cs
+	cc := cs.cc
+
+	n, err := cs.body.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	var connAdd, streamAdd int32
+	cc.mu.Lock()
+	if v := cc.inflow; v < cc.inflowTarget/2 {
+		connAdd = cc.inflowTarget - v
+		cc.inflow += connAdd
+	}
+	if _, active := cc.streams[cs.ID]; active && err == nil {
+		if v := cs.inflow; v < cc.streamInflow/2 {
+			streamAdd = cc.streamInflow - v
+			cs.inflow += streamAdd
+		}
+	}
+	cc.mu.Unlock()
+
+	if connAdd != 0 || streamAdd != 0 {
+		cc.writeFrames(func(fr *http2.Framer) {
+			if connAdd != 0 {
+				fr.WriteWindowUpdate(0, uint32(connAdd))
+			}
+			if streamAdd != 0 {
+				fr.WriteWindowUpdate(cs.ID, uint32(streamAdd))
+			}
+		})
+	}
+	return n, err
+}
+
+func (b h2ResponseBody) Close() error {
+	cs := b.cs
+	cc := cs.cc
+
+	unread := cs.body.BreakWithError(errH2ResponseBodyClosed)
+	cs.abort(errH2ResponseBodyClosed, true)
+
+	// give the connection level window of what we never read back
+	if unread > 0 {
+		cc.mu.Lock()
+		cc.inflow += int32(unread)
+		cc.mu.Unlock()
+
+		cc.writeFrames(func(fr *http2.Framer) {
+			fr.WriteWindowUpdate(0, uint32(unread))
+		})
+	}
+	return nil
+}
+
+// bodyPipe buffers a response payload between the read loop and the
+// reader of the response body.
+type bodyPipe struct {
+	mu  sync.Mutex
+	c   sync.Cond // c.L is &mu
+	b   bytes.Buffer
+	err error // read error once empty. non-nil means closed.
+}
+
+func (p *bodyPipe) Read(d []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.b.Len() == 0 && p.err == nil {
+		p.c.Wait()
+	}
+	if p.b.Len() > 0 {
+		return p.b.Read(d)
+	}
+	return 0, p.err
+}
+
+func (p *bodyPipe) Write(d []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return 0, errH2StreamClosed
+	}
+	defer p.c.Signal()
+	return p.b.Write(d)
+}
+
+// CloseWithError makes reads return err once the buffer is drained.
+func (p *bodyPipe) CloseWithError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == nil {
+		p.err = err
+		p.c.Broadcast()
+	}
+}
+
+// BreakWithError makes reads return err right away and returns the number
+// of bytes that were still buffered.
+func (p *bodyPipe) BreakWithError(err error) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	unread := p.b.Len()
+	p.b.Reset()
+	if p.err == nil {
+		p.err = err
+	}
+	p.c.Broadcast()
+	return unread
+}
+
+// gzipReader wraps a response body so it can lazily call gzip.NewReader on
+// the first call to Read.
+type gzipReader struct {
+	body io.ReadCloser // underlying Response.Body
+	zr   *gzip.Reader  // lazily-initialized gzip reader
+	zerr error         // sticky error
+}
+
+func (gz *gzipReader) Read(p []byte) (n int, err error) {
+	if gz.zerr != nil {
+		return 0, gz.zerr
+	}
+	if gz.zr == nil {
+		gz.zr, err = gzip.NewReader(gz.body)
+		if err != nil {
+			gz.zerr = err
+			return 0, err
+		}
+	}
+	return gz.zr.Read(p)
+}
+
+func (gz *gzipReader) Close() error {
+	return gz.body.Close()
+}
+
+// commaSeparatedTrailers returns the announced Trailer header of req.
+func commaSeparatedTrailers(req *http.Request) (string, error) {
+	keys := make([]string, 0, len(req.Trailer))
+	for k := range req.Trailer {
+		k = http.CanonicalHeaderKey(k)
+		switch k {
+		case "Transfer-Encoding", "Trailer", "Content-Length":
+			return "", fmt.Errorf("invalid Trailer key %q", k)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		return strings.Join(keys, ","), nil
+	}
+	return "", nil
+}
+
+// closeReqBody closes the body of a request that fails before a stream took
+// it over, a RoundTripper has to close it even on errors.
+func closeReqBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// rewindBody returns req ready to be sent again. A request with a body needs
+// GetBody for that, the body it had may have been read already.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("http: cannot rewind a request body without GetBody")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	newReq := *req
+	newReq.Body = body
+	return &newReq, nil
+}
+
+// actualContentLength returns a sanitized version of req.ContentLength,
+// where 0 actually means zero (not unknown) and -1 means unknown.
+func actualContentLength(req *http.Request) int64 {
+	if req.Body == nil || req.Body == http.NoBody {
+		return 0
+	}
+	if req.ContentLength != 0 {
+		return req.ContentLength
+	}
+	return -1
+}
@@ -0,0 +1,619 @@
+package httpmod
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// newH2Server returns a TLS server speaking HTTP/2, yet to be started, and
+// an H2Transport that trusts it. The transport presents the firefox_65
+// profile, the package level defaults send a MAX_FRAME_SIZE of 0 that
+// net/http rejects.
+func newH2Server(t *testing.T, handler http.Handler) (*httptest.Server, *H2Transport) {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+
+	firefox, err := ProfileByName("firefox_65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, &H2Transport{
+		Settings: firefox.h2Settings(),
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			return tls.Dial(network, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		},
+	}
+}
+
+func TestH2TransportCloseWhenIdle(t *testing.T) {
+	server, tr := newH2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	hook, states := connStates()
+	server.Config.ConnState = hook
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := tr.RoundTrip(mustRequest(t, "GET", server.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the request is still in flight, its connection goes once it is done
+	tr.closeWhenIdle()
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	waitConnState(t, states, http.StateClosed)
+}
+
+// fakeH2Conn is the server side of a connection an H2Transport dialed,
+// driven frame by frame by a test.
+type fakeH2Conn struct {
+	t      *testing.T
+	conn   net.Conn
+	fr     *http2.Framer
+	frames chan interface{} // frames read, closed when reading fails
+	hbuf   bytes.Buffer
+	henc   *hpack.Encoder
+}
+
+// newFakeH2Transport returns an H2Transport whose connections are served
+// by serve, which is passed the number of the connection starting at 0.
+func newFakeH2Transport(t *testing.T, serve func(n int, sc *fakeH2Conn)) *H2Transport {
+	firefox, err := ProfileByName("firefox_65")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	dials := 0
+	return &H2Transport{
+		Settings: firefox.h2Settings(),
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			mu.Lock()
+			n := dials
+			dials++
+			mu.Unlock()
+
+			client, server := net.Pipe()
+			sc := &fakeH2Conn{
+				t:      t,
+				conn:   server,
+				fr:     http2.NewFramer(server, server),
+				frames: make(chan interface{}, 100),
+			}
+			sc.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+			sc.henc = hpack.NewEncoder(&sc.hbuf)
+			go sc.readFrames()
+			go func() {
+				defer server.Close()
+				serve(n, sc)
+			}()
+			return client, nil
+		},
+	}
+}
+
+func (sc *fakeH2Conn) readFrames() {
+	defer close(sc.frames)
+
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(sc.conn, preface); err != nil {
+		return
+	}
+	for {
+		f, err := sc.fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		// the payload of DATA frames is reused by the next read
+		if data, ok := f.(*http2.DataFrame); ok {
+			sc.frames <- &fakeDataFrame{data.StreamID, data.StreamEnded(), append([]byte(nil), data.Data()...)}
+			continue
+		}
+		sc.frames <- f
+	}
+}
+
+// fakeDataFrame is the part of a DATA frame that outlives the next read.
+type fakeDataFrame struct {
+	streamID  uint32
+	endStream bool
+	data      []byte
+}
+
+// next returns the next frame match accepts, skipping the others. It
+// returns nil once the client closed the connection.
+func (sc *fakeH2Conn) next(match func(interface{}) bool) interface{} {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case f, ok := <-sc.frames:
+			if !ok {
+				return nil
+			}
+			if match(f) {
+				return f
+			}
+		case <-timeout:
+			sc.t.Error("timed out waiting for a frame")
+			return nil
+		}
+	}
+}
+
+// nextHeaders returns the next HEADERS frame.
+func (sc *fakeH2Conn) nextHeaders() *http2.MetaHeadersFrame {
+	f := sc.next(func(f interface{}) bool {
+		_, ok := f.(*http2.MetaHeadersFrame)
+		return ok
+	})
+	if f == nil {
+		return nil
+	}
+	return f.(*http2.MetaHeadersFrame)
+}
+
+// writeResponse sends the headers of a response with status on streamID.
+func (sc *fakeH2Conn) writeResponse(streamID uint32, status string, endStream bool) {
+	sc.hbuf.Reset()
+	sc.henc.WriteField(hpack.HeaderField{Name: ":status", Value: status})
+	sc.fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: sc.hbuf.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+}
+
+func TestH2TransportHeadWithData(t *testing.T) {
+	const frames = 4
+	returned := make(chan uint32, 1)
+	tr := newFakeH2Transport(t, func(n int, sc *fakeH2Conn) {
+		sc.fr.WriteSettings()
+		h := sc.nextHeaders()
+		if h == nil {
+			return
+		}
+
+		// a broken server sends a body anyway
+		sc.writeResponse(h.StreamID, "200", false)
+		for i := 0; i < frames; i++ {
+			sc.fr.WriteData(h.StreamID, false, make([]byte, 16384))
+		}
+		sc.fr.WriteData(h.StreamID, true, nil)
+
+		var total uint32
+		for total < frames*16384 {
+			f := sc.next(func(f interface{}) bool {
+				wu, ok := f.(*http2.WindowUpdateFrame)
+				return ok && wu.StreamID == 0
+			})
+			if f == nil {
+				break
+			}
+			total += f.(*http2.WindowUpdateFrame).Increment
+		}
+		returned <- total
+	})
+
+	resp, err := tr.RoundTrip(mustRequest(t, "HEAD", "https://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if total := <-returned; total != frames*16384 {
+		t.Errorf("connection window handed back: %d, want %d", total, frames*16384)
+	}
+}
+
+func TestH2TransportRetriesAfterGoAway(t *testing.T) {
+	tr := newFakeH2Transport(t, func(n int, sc *fakeH2Conn) {
+		sc.fr.WriteSettings()
+		h := sc.nextHeaders()
+		if h == nil {
+			return
+		}
+
+		if n == 0 {
+			// shutting down, the request wasn't looked at
+			sc.fr.WriteGoAway(0, http2.ErrCodeNo, nil)
+			sc.next(func(interface{}) bool { return false })
+			return
+		}
+
+		var body []byte
+		for {
+			f := sc.next(func(f interface{}) bool {
+				_, ok := f.(*fakeDataFrame)
+				return ok
+			})
+			if f == nil {
+				return
+			}
+			data := f.(*fakeDataFrame)
+			body = append(body, data.data...)
+			if data.endStream {
+				break
+			}
+		}
+		sc.writeResponse(h.StreamID, "200", false)
+		sc.fr.WriteData(h.StreamID, true, body)
+	})
+
+	resp, err := tr.RoundTrip(mustRequest(t, "POST", "https://example.com/", strings.NewReader("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("second connection got body %q, want hello", body)
+	}
+}
+
+func TestH2TransportPingTimeout(t *testing.T) {
+	closed := make(chan bool, 1)
+	tr := newFakeH2Transport(t, func(n int, sc *fakeH2Conn) {
+		sc.fr.WriteSettings()
+		h := sc.nextHeaders()
+		if h == nil {
+			return
+		}
+		sc.writeResponse(h.StreamID, "200", true)
+
+		// leave the PING unanswered
+		ping := sc.next(func(f interface{}) bool {
+			_, ok := f.(*http2.PingFrame)
+			return ok
+		})
+		if ping == nil {
+			closed <- false
+			return
+		}
+		closed <- sc.next(func(interface{}) bool { return false }) == nil
+	})
+	tr.ReadIdleTimeout = 50 * time.Millisecond
+	tr.PingTimeout = 50 * time.Millisecond
+
+	resp, err := tr.RoundTrip(mustRequest(t, "GET", "https://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !<-closed {
+		t.Error("connection wasn't pinged and closed")
+	}
+}
+
+func TestH2TransportIdleConnTimeout(t *testing.T) {
+	server, tr := newH2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	hook, states := connStates()
+	server.Config.ConnState = hook
+	server.StartTLS()
+	defer server.Close()
+	tr.IdleConnTimeout = 50 * time.Millisecond
+
+	resp, err := tr.RoundTrip(mustRequest(t, "GET", server.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	waitConnState(t, states, http.StateClosed)
+}
+
+func TestH2TransportConcurrentRequests(t *testing.T) {
+	server, tr := newH2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	server.StartTLS()
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			want := strings.Repeat("x", i*1000)
+			resp, err := tr.RoundTrip(mustRequest(t, "POST", server.URL, strings.NewReader(want)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != want {
+				t.Errorf("request %d: got %d bytes back, want %d", i, len(body), len(want))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// closeRecordingConn records Close without closing the connection, so the
+// read loop doesn't notice.
+type closeRecordingConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *closeRecordingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestH2TransportCloseIdleConnections(t *testing.T) {
+	server, tr := newH2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	server.StartTLS()
+	defer server.Close()
+
+	var conns []*closeRecordingConn
+	dial := tr.DialTLS
+	tr.DialTLS = func(network, addr string) (net.Conn, error) {
+		c, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := &closeRecordingConn{Conn: c, closed: make(chan struct{})}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Conn.Close()
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		resp, err := tr.RoundTrip(mustRequest(t, "GET", server.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// the connection must be out of the pool before it's closed, not
+		// once its read loop notices
+		tr.CloseIdleConnections()
+		select {
+		case <-conns[i].closed:
+		default:
+			t.Fatalf("request %d: idle connection wasn't closed", i)
+		}
+		tr.mu.Lock()
+		n := len(tr.conns)
+		tr.mu.Unlock()
+		if n != 0 {
+			t.Errorf("request %d: %d addresses still pooled after closing the idle connections", i, n)
+		}
+	}
+	if len(conns) != 2 {
+		t.Errorf("%d connections dialed, want one per request", len(conns))
+	}
+}
+
+// closeRecorder is a request body that records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (b *closeRecorder) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestH2TransportClosesBodyOnError(t *testing.T) {
+	server, tr := newH2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.StartTLS()
+	defer server.Close()
+
+	unreachable := &H2Transport{
+		Settings: tr.Settings,
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	}
+
+	tests := []struct {
+		name    string
+		tr      *H2Transport
+		url     string
+		header  http.Header
+		trailer http.Header
+	}{
+		{name: "scheme", tr: tr, url: strings.Replace(server.URL, "https", "http", 1)},
+		{name: "dial", tr: unreachable, url: server.URL},
+		{name: "trailer", tr: tr, url: server.URL, trailer: http.Header{"Content-Length": {"1"}}},
+		{name: "header", tr: tr, url: server.URL, header: http.Header{"X-Bad": {"a\nb"}}},
+	}
+
+	for _, test := range tests {
+		body := &closeRecorder{Reader: strings.NewReader("body"), closed: make(chan struct{})}
+		req := mustRequest(t, "POST", test.url, body)
+		for name, values := range test.header {
+			req.Header[name] = values
+		}
+		req.Trailer = test.trailer
+
+		if _, err := test.tr.RoundTrip(req); err == nil {
+			t.Errorf("%s: request succeeded", test.name)
+			continue
+		}
+		select {
+		case <-body.closed:
+		case <-time.After(time.Second):
+			t.Errorf("%s: body not closed after the request failed", test.name)
+		}
+	}
+}
+
+func TestEncodeRequestHeadersGeneratedHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    []string
+		header   http.Header
+		trailers string
+		fields   string
+	}{
+		{
+			name:   "no order",
+			header: http.Header{"X-B": {"b"}, "X-A": {"a"}},
+			fields: "x-a,x-b,content-length,accept-encoding,user-agent",
+		},
+		{
+			name:   "generated listed",
+			order:  []string{"User-Agent", "content-length", "X-B", "accept-encoding"},
+			header: http.Header{"X-B": {"b"}, "X-A": {"a"}},
+			fields: "user-agent,content-length,x-b,accept-encoding,x-a",
+		},
+		{
+			name:   "unlisted in between",
+			order:  []string{"x-b", UnlistedHeaders, "user-agent"},
+			header: http.Header{"X-B": {"b"}, "X-A": {"a"}},
+			fields: "x-b,x-a,content-length,accept-encoding,user-agent",
+		},
+		{
+			name:   "suppressed",
+			order:  []string{"user-agent", "content-length", "x-a", "accept-encoding"},
+			header: http.Header{"X-A": {"a"}, "User-Agent": nil, "Content-Length": nil, "Accept-Encoding": nil},
+			fields: "x-a",
+		},
+		{
+			name:     "trailer",
+			order:    []string{"x-a", "trailer"},
+			header:   http.Header{"X-A": {"a"}},
+			trailers: "X-T",
+			fields:   "x-a,trailer,content-length,accept-encoding,user-agent",
+		},
+		{
+			name:     "trailer suppressed",
+			header:   http.Header{"X-A": {"a"}, "Trailer": nil},
+			trailers: "X-T",
+			fields:   "x-a,content-length,accept-encoding,user-agent",
+		},
+	}
+
+	for _, test := range tests {
+		req := mustRequest(t, "POST", "https://example.com/", strings.NewReader("body"))
+		req.Header = test.header
+		settings := DefaultH2Settings()
+		settings.HeaderOrder = test.order
+
+		var names []string
+		err := encodeRequestHeaders(req, settings, true, test.trailers, 4, 0xffffffffffffffff, func(name, value string) {
+			if name[0] != ':' {
+				names = append(names, name)
+			}
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := strings.Join(names, ","); got != test.fields {
+			t.Errorf("%s: wrote %s, want %s", test.name, got, test.fields)
+		}
+	}
+}
+
+func TestEncodeRequestHeadersCookies(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     []string
+		combine   bool
+		placement CookiePlacement
+		cookies   []string
+		fields    string
+	}{
+		{
+			name:    "split in order",
+			order:   []string{"x-a", "cookie", "x-b"},
+			cookies: []string{"a=1; b=2;c=3"},
+			fields:  "x-a: a|cookie: a=1|cookie: b=2|cookie: c=3|x-b: b",
+		},
+		{
+			name:    "combined in order",
+			order:   []string{"x-a", "cookie", "x-b"},
+			combine: true,
+			cookies: []string{"a=1; b=2;c=3"},
+			fields:  "x-a: a|cookie: a=1; b=2; c=3|x-b: b",
+		},
+		{
+			name:    "combined from several values",
+			order:   []string{"cookie", "x-a", "x-b"},
+			combine: true,
+			cookies: []string{"a=1; b=2", "c=3"},
+			fields:  "cookie: a=1; b=2; c=3|x-a: a|x-b: b",
+		},
+		{
+			name:      "first",
+			order:     []string{"x-a", "x-b", "cookie"},
+			placement: CookiesFirst,
+			cookies:   []string{"a=1; b=2"},
+			fields:    "cookie: a=1|cookie: b=2|x-a: a|x-b: b",
+		},
+		{
+			name:      "last",
+			order:     []string{"cookie", "x-a", "x-b"},
+			combine:   true,
+			placement: CookiesLast,
+			cookies:   []string{"a=1; b=2"},
+			fields:    "x-a: a|x-b: b|cookie: a=1; b=2",
+		},
+		{
+			name:      "last without cookies",
+			order:     []string{"x-b", "x-a"},
+			placement: CookiesLast,
+			fields:    "x-b: b|x-a: a",
+		},
+	}
+
+	for _, test := range tests {
+		req := mustRequest(t, "GET", "https://example.com/", nil)
+		req.Header = http.Header{"X-A": {"a"}, "X-B": {"b"}, "User-Agent": nil}
+		if test.cookies != nil {
+			req.Header["Cookie"] = test.cookies
+		}
+		settings := DefaultH2Settings()
+		settings.HeaderOrder = test.order
+		settings.CombineCookies = test.combine
+		settings.CookiePlacement = test.placement
+
+		var fields []string
+		err := encodeRequestHeaders(req, settings, false, "", 0, 0xffffffffffffffff, func(name, value string) {
+			if name[0] != ':' {
+				fields = append(fields, name+": "+value)
+			}
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := strings.Join(fields, "|"); got != test.fields {
+			t.Errorf("%s: wrote %s, want %s", test.name, got, test.fields)
+		}
+	}
+}
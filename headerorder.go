@@ -0,0 +1,197 @@
+package httpmod
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"reflect"
+	"strings"
+	"sync"
+	_ "unsafe"
+)
+
+// UnlistedHeaders marks the spot in a header order where the headers it
+// doesn't mention go, e.g. []string{"Host", "User-Agent", UnlistedHeaders,
+// "Accept-Encoding"}. Without it they follow the listed ones.
+const UnlistedHeaders = "*"
+
+// DefaultHeaderOrder is used for requests that don't ask for an order of
+// their own with WithHeaderOrder or HeaderOrderKey.
+// H2Settings.HeaderOrder and H1Transport.HeaderOrder take precedence for
+// their own transports. Nil keeps the order net/http would use, which sorts
+// the request headers by name.
+var DefaultHeaderOrder []string
+
+// arrangeHeaders returns names arranged by order. names lists the headers to
+// send in the transport's own order. The names order mentions are returned
+// with the casing used in order, the others keep theirs and their relative
+// order and end up at UnlistedHeaders, or at the end. Names are compared
+// case-insensitively and each one is returned once.
+func arrangeHeaders(order, names []string) []string {
+	if order == nil {
+		return names
+	}
+
+	listed := make(map[string]bool)
+	var before, after []string
+	var seenPlaceholder bool
+	for _, name := range order {
+		if name == UnlistedHeaders {
+			seenPlaceholder = true
+			continue
+		}
+		lowKey := strings.ToLower(name)
+		if listed[lowKey] {
+			continue
+		}
+		listed[lowKey] = true
+		if seenPlaceholder {
+			after = append(after, name)
+		} else {
+			before = append(before, name)
+		}
+	}
+
+	result := before
+	for _, name := range names {
+		lowKey := strings.ToLower(name)
+		if listed[lowKey] {
+			continue
+		}
+		listed[lowKey] = true
+		result = append(result, name)
+	}
+	return append(result, after...)
+}
+
+type headerOrderKey struct{}
+
+type pseudoHeaderOrderKey struct{}
+
+// WithHeaderOrder returns a copy of ctx that makes the request it is attached
+// to write its headers in order, which may hold UnlistedHeaders. Unlike
+// HeaderOrderKey the order never travels in the header map, so redirects,
+// dumps and unpatched writers can't put it on the wire. It takes precedence
+// over HeaderOrderKey.
+//
+// net/http doesn't hand the request to its HTTP/1.1 header writer, so under
+// Apply the order is looked up among the requests in flight in
+// http.Transport.RoundTrip, Request.Write and Request.WriteProxy. Direct calls
+// of those the compiler inlined aren't seen, requests sent through an
+// http.Client always are.
+func WithHeaderOrder(ctx context.Context, order ...string) context.Context {
+	return context.WithValue(ctx, headerOrderKey{}, append([]string(nil), order...))
+}
+
+// WithPseudoHeaderOrder returns a copy of ctx that makes the request it is
+// attached to write its HTTP/2 pseudo headers in order. It takes precedence
+// over PseudoHeaderOrderKey and H2Settings.PseudoHeaderOrder.
+func WithPseudoHeaderOrder(ctx context.Context, order ...string) context.Context {
+	return context.WithValue(ctx, pseudoHeaderOrderKey{}, append([]string(nil), order...))
+}
+
+// requestHeaderOrder returns the header order req asks for, from its context
+// or HeaderOrderKey.
+func requestHeaderOrder(req *http.Request) ([]string, bool) {
+	if order, ok := req.Context().Value(headerOrderKey{}).([]string); ok {
+		return order, true
+	}
+	order, ok := req.Header[HeaderOrderKey]
+	return order, ok
+}
+
+// requestPseudoHeaderOrder returns the pseudo header order req asks for,
+// from its context or PseudoHeaderOrderKey.
+func requestPseudoHeaderOrder(req *http.Request) ([]string, bool) {
+	if order, ok := req.Context().Value(pseudoHeaderOrderKey{}).([]string); ok {
+		return order, true
+	}
+	order, ok := req.Header[PseudoHeaderOrderKey]
+	return order, ok
+}
+
+// requestsInFlight are the requests net/http is writing, keyed by what its
+// HTTP/1.1 header writer is called with for them.
+var requestsInFlight = struct {
+	sync.Mutex
+	m map[inFlightKey][]*http.Request
+}{m: make(map[inFlightKey][]*http.Request)}
+
+// inFlightKey tells apart requests that share a header map, which
+// Request.WithContext copies do, by their trace. Of requests in flight that
+// share both, the first one tracked gives the order.
+type inFlightKey struct {
+	header uintptr
+	trace  *httptrace.ClientTrace
+}
+
+func inFlightKeyOf(h http.Header, trace *httptrace.ClientTrace) inFlightKey {
+	return inFlightKey{header: reflect.ValueOf(h).Pointer(), trace: trace}
+}
+
+// trackRequest makes req known to the header writer until the returned
+// func is called.
+func trackRequest(req *http.Request) (untrack func()) {
+	key := inFlightKeyOf(req.Header, httptrace.ContextClientTrace(req.Context()))
+
+	requestsInFlight.Lock()
+	requestsInFlight.m[key] = append(requestsInFlight.m[key], req)
+	requestsInFlight.Unlock()
+
+	return func() {
+		requestsInFlight.Lock()
+		defer requestsInFlight.Unlock()
+
+		reqs := requestsInFlight.m[key]
+		for i, r := range reqs {
+			if r == req {
+				reqs = append(reqs[:i:i], reqs[i+1:]...)
+				break
+			}
+		}
+		if len(reqs) == 0 {
+			delete(requestsInFlight.m, key)
+			return
+		}
+		requestsInFlight.m[key] = reqs
+	}
+}
+
+// inFlightHeaderOrder returns the order WithHeaderOrder attached to the
+// request in flight whose headers are h and whose trace is trace.
+func inFlightHeaderOrder(h http.Header, trace *httptrace.ClientTrace) ([]string, bool) {
+	requestsInFlight.Lock()
+	reqs := requestsInFlight.m[inFlightKeyOf(h, trace)]
+	requestsInFlight.Unlock()
+
+	if len(reqs) == 0 {
+		return nil, false
+	}
+	order, ok := reqs[0].Context().Value(headerOrderKey{}).([]string)
+	return order, ok
+}
+
+//go:linkname transportRoundTrip net/http.(*Transport).roundTrip
+func transportRoundTrip(t *http.Transport, req *http.Request) (*http.Response, error)
+
+//go:linkname requestWrite net/http.(*Request).write
+func requestWrite(r *http.Request, w io.Writer, usingProxy bool, extraHeaders http.Header, waitForContinue func() bool) error
+
+// patchedTransportRoundTrip, patchedRequestWrite and patchedRequestWriteProxy
+// are the exported wrappers of net/http around the functions that write
+// requests, tracking the request while it is written.
+func patchedTransportRoundTrip(t *http.Transport, req *http.Request) (*http.Response, error) {
+	defer trackRequest(req)()
+	return transportRoundTrip(t, req)
+}
+
+func patchedRequestWrite(r *http.Request, w io.Writer) error {
+	defer trackRequest(r)()
+	return requestWrite(r, w, false, nil, nil)
+}
+
+func patchedRequestWriteProxy(r *http.Request, w io.Writer) error {
+	defer trackRequest(r)()
+	return requestWrite(r, w, true, nil, nil)
+}
@@ -0,0 +1,196 @@
+package httpmod
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// headerLines returns the names of the X- headers in the wire format b, in
+// order.
+func headerLines(b []byte) []string {
+	var names []string
+	for _, line := range strings.Split(string(b), "\r\n") {
+		if strings.HasPrefix(line, "X-") {
+			names = append(names, line[:strings.Index(line, ":")])
+		}
+	}
+	return names
+}
+
+func TestDefaultHeaderOrderOnlyForRequests(t *testing.T) {
+	h := Apply()
+	defer h.Remove()
+
+	DefaultHeaderOrder = []string{"X-B", "X-A"}
+	defer func() { DefaultHeaderOrder = nil }()
+
+	header := http.Header{"X-A": {"a"}, "X-B": {"b"}}
+
+	var buf bytes.Buffer
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header = header
+	req.Write(&buf)
+	if got := strings.Join(headerLines(buf.Bytes()), ","); got != "X-B,X-A" {
+		t.Errorf("request headers written as %s, want X-B,X-A", got)
+	}
+
+	buf.Reset()
+	resp := &http.Response{StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: header}
+	resp.Write(&buf)
+	if got := strings.Join(headerLines(buf.Bytes()), ","); got != "X-A,X-B" {
+		t.Errorf("response headers written as %s, want them sorted", got)
+	}
+
+	buf.Reset()
+	header.Write(&buf)
+	if got := strings.Join(headerLines(buf.Bytes()), ","); got != "X-A,X-B" {
+		t.Errorf("Header.Write wrote %s, want the headers sorted", got)
+	}
+}
+
+// sendRecorded sends req with an http.Client using rt and returns the
+// request head the server got. A nil rt is an http.Transport, which the
+// client hands the request to through the patched Transport.RoundTrip.
+func sendRecorded(t *testing.T, rt http.RoundTripper, req *http.Request) []byte {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	head := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			head <- nil
+			return
+		}
+		defer c.Close()
+		tp := textproto.NewReader(bufio.NewReader(c))
+		var buf bytes.Buffer
+		for {
+			line, err := tp.ReadLine()
+			if err != nil || line == "" {
+				break
+			}
+			buf.WriteString(line + "\r\n")
+		}
+		io.WriteString(c, "HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n")
+		head <- buf.Bytes()
+	}()
+
+	req.URL.Host = l.Addr().String()
+	if rt == nil {
+		rt = &http.Transport{}
+	}
+	client := &http.Client{Transport: rt}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return <-head
+}
+
+func TestWithHeaderOrder(t *testing.T) {
+	h := Apply()
+	defer h.Remove()
+
+	var wrote []string
+	laterTrace := &httptrace.ClientTrace{
+		WroteHeaderField: func(key string, value []string) {
+			wrote = append(wrote, key)
+		},
+		// a PutIdleConn hook of its own doesn't lose the order
+		PutIdleConn: func(error) {},
+	}
+
+	tests := []struct {
+		name string
+		ctx  func() context.Context
+		want string
+	}{
+		{
+			name: "order",
+			ctx: func() context.Context {
+				return WithHeaderOrder(context.Background(), "X-C", "X-A", "X-B")
+			},
+			want: "X-C,X-A,X-B",
+		},
+		{
+			name: "later trace",
+			ctx: func() context.Context {
+				ctx := WithHeaderOrder(context.Background(), "X-C", "X-A", "X-B")
+				return httptrace.WithClientTrace(ctx, laterTrace)
+			},
+			want: "X-C,X-A,X-B",
+		},
+		{
+			name: "earlier trace",
+			ctx: func() context.Context {
+				ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{})
+				return WithHeaderOrder(ctx, UnlistedHeaders, "X-A")
+			},
+			want: "X-B,X-C,X-A",
+		},
+		{
+			name: "no order",
+			ctx:  context.Background,
+			want: "X-A,X-B,X-C",
+		},
+	}
+
+	for _, test := range tests {
+		wrote = nil
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req = req.WithContext(test.ctx())
+		req.Header = http.Header{"X-A": {"a"}, "X-B": {"b"}, "X-C": {"c"}}
+
+		head := sendRecorded(t, nil, req)
+		if got := strings.Join(headerLines(head), ","); got != test.want {
+			t.Errorf("%s: headers written as %s, want %s", test.name, got, test.want)
+		}
+		if test.name == "later trace" && len(wrote) == 0 {
+			t.Errorf("%s: the later trace wasn't called", test.name)
+		}
+	}
+
+	requestsInFlight.Lock()
+	n := len(requestsInFlight.m)
+	requestsInFlight.Unlock()
+	if n != 0 {
+		t.Errorf("%d requests still tracked after they were sent", n)
+	}
+}
+
+// TestWithHeaderOrderSharedHeader checks that copies of a request made with
+// WithContext, which share the header map, keep their own orders.
+func TestWithHeaderOrderSharedHeader(t *testing.T) {
+	h := Apply()
+	defer h.Remove()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header = http.Header{"X-A": {"a"}, "X-B": {"b"}}
+	withTrace := func(order ...string) context.Context {
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{})
+		return WithHeaderOrder(ctx, order...)
+	}
+	first := req.WithContext(withTrace("X-B", "X-A"))
+	second := req.WithContext(withTrace("X-A", "X-B"))
+
+	// the first one stays in flight while the second is written
+	untrack := trackRequest(first)
+	defer untrack()
+
+	if got := strings.Join(headerLines(sendRecorded(t, nil, second)), ","); got != "X-A,X-B" {
+		t.Errorf("second request wrote %s, want X-A,X-B", got)
+	}
+}
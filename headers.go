@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
-	"errors"
 	"fmt"
 	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/http2"
@@ -13,6 +12,9 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/textproto"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,11 +22,46 @@ import (
 	_ "unsafe"
 )
 
-type OrderedHeader http.Header
+const (
+	// HeaderOrderKey lists the header names of a request in the order they
+	// are written. The patched writers never send it, but it travels in the
+	// header map, so anything else writing the headers does. Prefer
+	// WithHeaderOrder.
+	HeaderOrderKey = "Custom-Header-Order"
+
+	// PseudoHeaderOrderKey lists the HTTP/2 pseudo headers of a request in
+	// the order they are written, overriding H2Settings.PseudoHeaderOrder.
+	// Like HeaderOrderKey it travels in the header map, prefer
+	// WithPseudoHeaderOrder.
+	PseudoHeaderOrderKey = "Custom-Pseudo-Header-Order"
+)
+
+// defaultPseudoHeaderOrder is used when neither the request nor the
+// transport specify an order.
+var defaultPseudoHeaderOrder = []string{":authority", ":method", ":path", ":scheme"}
+
+// pseudoHeaderOrder returns the order to write the pseudo headers of req in.
+// Pseudo headers that the chosen order leaves out are appended in the
+// default order, because a request can't do without them.
+func pseudoHeaderOrder(req *http.Request, settings *H2Settings) []string {
+	order, ok := requestPseudoHeaderOrder(req)
+	if !ok {
+		order = settings.PseudoHeaderOrder
+	}
+
+	candidates := append(append([]string(nil), order...), defaultPseudoHeaderOrder...)
 
-func (oh OrderedHeader) Add(key, value string) {
-	oh["Custom-Header-Order"] = append(oh["Custom-Header-Order"], key)
-	oh[key] = append(oh[key], value)
+	seen := make(map[string]bool)
+	var result []string
+	for _, name := range candidates {
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return result
 }
 
 //go:linkname customHeaderValidation vendor/golang.org/x/net/http/httpguts.ValidHeaderFieldValue
@@ -33,8 +70,81 @@ func customHeaderValidation(a string) bool
 //go:linkname stdlibEncodeHeaders golang.org/x/net/http2.(*ClientConn).encodeHeaders
 func stdlibEncodeHeaders(cc *ClientConn, req *http.Request, addGzipHeader bool, trailers string, contentLength int64) ([]byte, error)
 
-// mostly YOINKED from http2. Only changing the header order
 func patchedEncodeHeaders(cc *ClientConn, req *http.Request, addGzipHeader bool, trailers string, contentLength int64) ([]byte, error) {
+	settings := connSettings(cc)
+	if settings == nil {
+		return encodeHeadersLikeStdlib(cc, req, addGzipHeader, trailers, contentLength)
+	}
+
+	cc.hbuf.Reset()
+
+	write := func(name, value string) {
+		writeHeader(cc, name, value)
+	}
+	if enc := connEncoder(cc); enc != nil {
+		write = func(name, value string) {
+			enc.WriteField(name, value)
+		}
+	}
+	err := encodeRequestHeaders(req, settings, addGzipHeader, trailers, contentLength, cc.peerMaxHeaderListSize, write)
+	if err != nil {
+		return nil, err
+	}
+
+	setPendingPriority(cc, headersPriority(req, settings))
+
+	return cc.hbuf.Bytes(), nil
+}
+
+//go:linkname stdlibEncodeTrailers golang.org/x/net/http2.(*ClientConn).encodeTrailers
+func stdlibEncodeTrailers(cc *ClientConn, req *http.Request) ([]byte, error)
+
+// mostly YOINKED from http2's encodeTrailers. Only encoding with the
+// encoder of the connection if it has one, which has to see every header
+// block to keep its dynamic table in sync with the peer
+func patchedEncodeTrailers(cc *ClientConn, req *http.Request) ([]byte, error) {
+	write := func(name, value string) {
+		writeHeader(cc, name, value)
+	}
+	if enc := connEncoder(cc); enc != nil {
+		write = func(name, value string) {
+			enc.WriteField(name, value)
+		}
+	}
+
+	cc.hbuf.Reset()
+
+	hlSize := uint64(0)
+	for k, vv := range req.Trailer {
+		for _, v := range vv {
+			hf := hpack.HeaderField{Name: k, Value: v}
+			hlSize += uint64(hf.Size())
+		}
+	}
+	if hlSize > cc.peerMaxHeaderListSize {
+		return nil, errRequestHeaderListSize
+	}
+
+	for k, vv := range req.Trailer {
+		// Transfer-Encoding, etc.. have already been filtered at the
+		// start of RoundTrip
+		lowKey := strings.ToLower(k)
+		for _, v := range vv {
+			write(lowKey, v)
+		}
+	}
+	return cc.hbuf.Bytes(), nil
+}
+
+//go:linkname errRequestHeaderListSize golang.org/x/net/http2.errRequestHeaderListSize
+var errRequestHeaderListSize error
+
+// encodeHeadersLikeStdlib is http2's encodeHeaders, for connections of
+// transports that weren't configured. The patch stays in place while other
+// goroutines may be running the function, so the original can't be called.
+//
+// YOINKED from http2's encodeHeaders
+func encodeHeadersLikeStdlib(cc *ClientConn, req *http.Request, addGzipHeader bool, trailers string, contentLength int64) ([]byte, error) {
 	cc.hbuf.Reset()
 
 	host := req.Host
@@ -159,7 +269,7 @@ func patchedEncodeHeaders(cc *ClientConn, req *http.Request, addGzipHeader bool,
 			f("accept-encoding", "gzip")
 		}
 		if !didUA {
-			f("user-agent", "Go-Client")
+			f("user-agent", "Go-http-client/2.0")
 		}
 	}
 
@@ -169,57 +279,221 @@ func patchedEncodeHeaders(cc *ClientConn, req *http.Request, addGzipHeader bool,
 	// modifying the hpack state.
 	hlSize := uint64(0)
 	enumerateHeaders(func(name, value string) {
-		if name == "Custom-Header-Order" {
-			return
+		hf := hpack.HeaderField{Name: name, Value: value}
+		hlSize += uint64(hf.Size())
+	})
+
+	if hlSize > cc.peerMaxHeaderListSize {
+		return nil, errRequestHeaderListSize
+	}
+
+	trace := httptrace.ContextClientTrace(req.Context())
+	traceHeaders := trace != nil && trace.WroteHeaderField != nil
+
+	// Header list size is ok. Write the headers.
+	enumerateHeaders(func(name, value string) {
+		name = strings.ToLower(name)
+		writeHeader(cc, name, value)
+		if traceHeaders {
+			trace.WroteHeaderField(name, []string{value})
+		}
+	})
+
+	return cc.hbuf.Bytes(), nil
+}
+
+// encodeRequestHeaders passes the HTTP/2 header fields of req to
+// writeHeader, in the order configured by the request or settings. Names
+// are passed in lower case.
+//
+// mostly YOINKED from http2's encodeHeaders. Only changing the header order
+func encodeRequestHeaders(req *http.Request, settings *H2Settings, addGzipHeader bool, trailers string, contentLength int64, peerMaxHeaderListSize uint64, writeHeader func(name, value string)) error {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	host, err := httpguts.PunycodeHostPort(host)
+	if err != nil {
+		return err
+	}
+
+	var path string
+	if req.Method != "CONNECT" {
+		path = req.URL.RequestURI()
+		if !validPseudoPath(path) {
+			orig := path
+			path = strings.TrimPrefix(path, req.URL.Scheme+"://"+host)
+			if !validPseudoPath(path) {
+				if req.URL.Opaque != "" {
+					return fmt.Errorf("invalid request :path %q from URL.Opaque = %q", orig, req.URL.Opaque)
+				} else {
+					return fmt.Errorf("invalid request :path %q", orig)
+				}
+			}
+		}
+	}
+
+	// Check for any invalid headers and return an error before we
+	// potentially pollute our hpack state. (We want to be able to
+	// continue to reuse the hpack encoder for future requests)
+	for k, vv := range req.Header {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return fmt.Errorf("invalid HTTP header name %q", k)
+		}
+		for _, v := range vv {
+			if !httpguts.ValidHeaderFieldValue(v) {
+				return fmt.Errorf("invalid HTTP header value %q for header %q", v, k)
+			}
+		}
+	}
+
+	pseudoOrder := pseudoHeaderOrder(req, settings)
+
+	// sorted, so headers the order doesn't mention still come out the same
+	// way every time
+	keys := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	enumerateHeaders := func(f func(name, value string)) {
+		// 8.1.2.3 Request Pseudo-Header Fields
+		// The :path pseudo-header field includes the path and query parts of the
+		// target URI (the path-absolute production and optionally a '?' character
+		// followed by the query production (see Sections 3.3 and 3.4 of
+		// [RFC3986]).
+		m := req.Method
+		if m == "" {
+			m = http.MethodGet
+		}
+		pseudoHeaders := map[string]string{
+			":authority": host,
+			":method":    m,
+		}
+		if req.Method != "CONNECT" {
+			pseudoHeaders[":path"] = path
+			pseudoHeaders[":scheme"] = req.URL.Scheme
+		}
+		for _, name := range pseudoOrder {
+			if value, ok := pseudoHeaders[name]; ok {
+				f(name, value)
+			}
+		}
+		if trailers != "" && !suppressedHeader(req.Header, "Trailer") {
+			f("trailer", trailers)
 		}
 
+		var didUA bool
+		for _, k := range keys {
+			vv := req.Header[k]
+			if k == HeaderOrderKey || k == PseudoHeaderOrderKey {
+				// ordering metadata, never sent
+				continue
+			} else if strings.EqualFold(k, "host") || strings.EqualFold(k, "content-length") {
+				// Host is :authority, already sent.
+				// Content-Length is automatic, set below.
+				continue
+			} else if strings.EqualFold(k, "connection") || strings.EqualFold(k, "proxy-connection") ||
+				strings.EqualFold(k, "transfer-encoding") || strings.EqualFold(k, "upgrade") ||
+				strings.EqualFold(k, "keep-alive") {
+				// Per 8.1.2.2 Connection-Specific Header
+				// Fields, don't send connection-specific
+				// fields. We have already checked if any
+				// are error-worthy so just ignore the rest.
+				continue
+			} else if strings.EqualFold(k, "user-agent") {
+				// Match Go's http1 behavior: at most one
+				// User-Agent. If set to nil or empty string,
+				// then omit it. Otherwise if not mentioned,
+				// include the default (below).
+				didUA = true
+				if len(vv) < 1 {
+					continue
+				}
+				vv = vv[:1]
+				if vv[0] == "" {
+					continue
+				}
+			} else if strings.EqualFold(k, "cookie") {
+				for _, v := range cookieFields(vv, settings.CombineCookies) {
+					f("cookie", v)
+				}
+				continue
+			}
+
+			for _, v := range vv {
+				f(k, v)
+			}
+		}
+		if shouldSendReqContentLength(req.Method, contentLength) && !suppressedHeader(req.Header, "Content-Length") {
+			f("content-length", strconv.FormatInt(contentLength, 10))
+		}
+		if addGzipHeader && !suppressedHeader(req.Header, "Accept-Encoding") {
+			f("accept-encoding", "gzip")
+		}
+		if !didUA {
+			f("user-agent", "Go-Client")
+		}
+	}
+
+	// Do a first pass over the headers counting bytes to ensure
+	// we don't exceed peerMaxHeaderListSize. This is done as a
+	// separate pass before encoding the headers to prevent
+	// modifying the hpack state.
+	hlSize := uint64(0)
+	enumerateHeaders(func(name, value string) {
 		hf := hpack.HeaderField{Name: name, Value: value}
 		hlSize += uint64(hf.Size())
 	})
 
-	if hlSize > cc.peerMaxHeaderListSize {
-		return nil, errors.New("max header list size exceeded")
+	if hlSize > peerMaxHeaderListSize {
+		return errRequestHeaderListSize
 	}
 
 	headersToSend := make(map[string][]string)
+	var enumerated []string
 
 	// enumerate the headers to send the http2 headers
 	enumerateHeaders(func(name, value string) {
 		// always send "http2" headers first
 		if name[0] == ':' {
 			lowKey := strings.ToLower(name)
-			writeHeader(cc, lowKey, value)
+			writeHeader(lowKey, value)
 			return
 		}
 
-		// don't want to send this one
-		if name == "Custom-Header-Order" {
-			return
+		lowKey := strings.ToLower(name)
+		if _, ok := headersToSend[lowKey]; !ok {
+			enumerated = append(enumerated, lowKey)
 		}
-		headersToSend[name] = append(headersToSend[name], value)
+		headersToSend[lowKey] = append(headersToSend[lowKey], value)
 	})
 
-	// don't change anything if custom headers haven't been used
-	headerOrder, ok := req.Header["Custom-Header-Order"]
+	// The listed headers go first, generated ones included. The rest
+	// follows in the order they were enumerated in: trailer, the request
+	// headers sorted by name, content-length, accept-encoding and
+	// user-agent.
+	headerOrder, ok := requestHeaderOrder(req)
 	if !ok {
-		enumerateHeaders(func(name, value string) {
-			// already sent these headers
-			if name[0] == ':' {
-				return
-			}
-			lowKey := strings.ToLower(name)
-			writeHeader(cc, lowKey, value)
-		})
-	} else {
-		for _, name := range headerOrder {
-			for _, value := range headersToSend[name] {
-				lowKey := strings.ToLower(name)
-				writeHeader(cc, lowKey, value)
-			}
+		headerOrder = settings.HeaderOrder
+	}
+	for _, name := range placeCookies(arrangeHeaders(headerOrder, enumerated), settings.CookiePlacement) {
+		lowKey := strings.ToLower(name)
+		for _, value := range headersToSend[lowKey] {
+			writeHeader(lowKey, value)
 		}
 	}
 
-	return cc.hbuf.Bytes(), nil
+	return nil
+}
+
+// suppressedHeader reports whether h holds name without any values, which
+// asks the transport to leave out the header it would generate for name.
+// This is the same convention net/http servers use to suppress Date.
+func suppressedHeader(h http.Header, name string) bool {
+	values, ok := lookupHeader(h, name)
+	return ok && len(values) == 0
 }
 //go:linkname writeHeader golang.org/x/net/http2.(*ClientConn).writeHeader
 func writeHeader(cc *ClientConn, name, value string)
@@ -233,33 +507,77 @@ func patchedHeaderWriteSubset(h http.Header, w io.Writer, exclude map[string]boo
 		ws = stringWriter{w}
 	}
 
-	customOrder, exists := h["Custom-Header-Order"]
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// the request isn't passed in, it is found among the ones in flight
+	order, exists := inFlightHeaderOrder(h, trace)
 	if !exists {
-		for key, values := range h {
-			for _, value := range values {
-				for _, s := range []string{key, ": ", value, "\r\n"} {
-					if _, err := ws.WriteString(s); err != nil {
-						return err
-					}
-				}
-			}
-		}
-		return nil
+		order, exists = h[HeaderOrderKey]
 	}
+	if !exists && writingRequest(exclude, trace) {
+		order = DefaultHeaderOrder
+	}
+	return writeHeaderLines(h, ws, arrangeHeaders(order, keys), exclude, trace)
+}
+
+//go:linkname reqWriteExcludeHeader net/http.reqWriteExcludeHeader
+var reqWriteExcludeHeader map[string]bool
 
-	for _, key := range customOrder {
-		for _, value := range h[key] {
-			for _, s := range []string{key, ": ", value,  "\r\n"} {
+// writingRequest reports whether writeSubset was called for the headers of
+// a client request, which net/http writes with reqWriteExcludeHeader and
+// the trace of the request. Responses and Header.Write get no trace and
+// keep the order net/http would use.
+func writingRequest(exclude map[string]bool, trace *httptrace.ClientTrace) bool {
+	return trace != nil || exclude != nil && reflect.ValueOf(exclude).Pointer() == reflect.ValueOf(reqWriteExcludeHeader).Pointer()
+}
+
+// writeHeaderLines writes the headers of h named by keys, in that order,
+// the way the unpatched writeSubset does. keys may use a different casing
+// than h, the values are looked up with lookupHeader.
+//
+// mostly YOINKED from net/http
+func writeHeaderLines(h http.Header, ws io.StringWriter, keys []string, exclude map[string]bool, trace *httptrace.ClientTrace) error {
+	var formattedVals []string
+	for _, key := range keys {
+		if exclude[key] || exclude[textproto.CanonicalMIMEHeaderKey(key)] || key == HeaderOrderKey || key == PseudoHeaderOrderKey {
+			continue
+		}
+		values, ok := lookupHeader(h, key)
+		if !ok {
+			// listed in the order but not set
+			continue
+		}
+		if !httpguts.ValidHeaderFieldName(key) {
+			// This could be an error. In the common case of
+			// writing response headers, however, we have no good
+			// way to provide the error back to the server
+			// handler, so just drop invalid headers instead.
+			continue
+		}
+		for _, v := range values {
+			v = headerNewlineToSpace.Replace(v)
+			v = textproto.TrimString(v)
+			for _, s := range []string{key, ": ", v, "\r\n"} {
 				if _, err := ws.WriteString(s); err != nil {
 					return err
 				}
 			}
+			if trace != nil && trace.WroteHeaderField != nil {
+				formattedVals = append(formattedVals, v)
+			}
+		}
+		if trace != nil && trace.WroteHeaderField != nil {
+			trace.WroteHeaderField(key, formattedVals)
+			formattedVals = nil
 		}
 	}
 	return nil
 }
 
-
 // ClientConn is the state of a single HTTP/2 client connection to an
 // HTTP/2 server.
 type ClientConn struct {
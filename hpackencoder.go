@@ -0,0 +1,316 @@
+package httpmod
+
+import (
+	"io"
+	"math"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HeaderIndexing is the HPACK representation of a header field that isn't
+// found in the static or dynamic table.
+type HeaderIndexing int
+
+const (
+	// IndexIncremental adds the field to the dynamic table if it fits, like
+	// hpack.Encoder does.
+	IndexIncremental HeaderIndexing = iota
+
+	// IndexWithout sends the field as a literal without indexing. A field
+	// that is in a table already is still sent as an index.
+	IndexWithout
+
+	// IndexNever sends the field as a never indexed literal, which asks
+	// intermediaries not to index it either. It is never sent as an
+	// index, not even when the static table holds the same value.
+	IndexNever
+)
+
+// HuffmanMode says when the strings of a header field are Huffman encoded.
+type HuffmanMode int
+
+const (
+	// HuffmanShortest uses Huffman encoding when it is shorter, like
+	// hpack.Encoder does.
+	HuffmanShortest HuffmanMode = iota
+
+	// HuffmanAlways Huffman encodes every string.
+	HuffmanAlways
+
+	// HuffmanNever sends every string as is.
+	HuffmanNever
+)
+
+// HeaderEncoding describes how a header field is encoded with HPACK.
+type HeaderEncoding struct {
+	Indexing HeaderIndexing
+	Huffman  HuffmanMode
+}
+
+// hpackStaticTable is the static table from appendix A of RFC 7541.
+var hpackStaticTable = []hpack.HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// hpackEncoder is an HPACK encoder that lets the representation of every
+// field be chosen. With the zero HeaderEncoding for every field its output
+// is the same as that of hpack.Encoder.
+type hpackEncoder struct {
+	w io.Writer
+
+	encodings       map[string]HeaderEncoding
+	defaultEncoding HeaderEncoding
+
+	// dynamic table, newest entry first
+	table   []hpack.HeaderField
+	size    uint32
+	maxSize uint32
+
+	// wantSize is the table size to use whenever the peer allows it
+	wantSize uint32
+
+	// mostly YOINKED from hpack.Encoder
+	minSize         uint32
+	maxSizeLimit    uint32
+	tableSizeUpdate bool
+
+	buf []byte
+}
+
+// newHPACKEncoder returns an encoder writing to w that encodes fields as
+// settings ask.
+func newHPACKEncoder(w io.Writer, settings *H2Settings) *hpackEncoder {
+	e := &hpackEncoder{
+		w:               w,
+		encodings:       settings.HeaderEncodings,
+		defaultEncoding: settings.DefaultHeaderEncoding,
+		wantSize:        settings.EncoderTableSize,
+		maxSize:         4096,
+		minSize:         math.MaxUint32,
+		maxSizeLimit:    4096, // spec default until the peer says otherwise
+	}
+	if e.wantSize == 0 {
+		e.wantSize = 4096
+	}
+	if e.wantSize < e.maxSize {
+		e.SetMaxDynamicTableSize(e.wantSize)
+	}
+	if settings.TableSizeUpdate {
+		e.tableSizeUpdate = true
+	}
+	return e
+}
+
+// WriteField encodes the field name: value to w.
+func (e *hpackEncoder) WriteField(name, value string) error {
+	e.buf = e.buf[:0]
+
+	if e.tableSizeUpdate {
+		e.tableSizeUpdate = false
+		if e.minSize < e.maxSize {
+			e.buf = appendHPACKInt(e.buf, 5, 0x20, uint64(e.minSize))
+		}
+		e.minSize = math.MaxUint32
+		e.buf = appendHPACKInt(e.buf, 5, 0x20, uint64(e.maxSize))
+	}
+
+	encoding, ok := e.encodings[name]
+	if !ok {
+		encoding = e.defaultEncoding
+	}
+	f := hpack.HeaderField{Name: name, Value: value, Sensitive: encoding.Indexing == IndexNever}
+
+	idx, nameValueMatch := e.search(f)
+	if nameValueMatch {
+		e.buf = appendHPACKInt(e.buf, 7, 0x80, idx)
+	} else {
+		indexing := encoding.Indexing == IndexIncremental && f.Size() <= e.maxSize
+		if indexing {
+			e.add(f)
+		}
+
+		switch {
+		case indexing:
+			e.buf = appendHPACKInt(e.buf, 6, 0x40, idx)
+		case f.Sensitive:
+			e.buf = appendHPACKInt(e.buf, 4, 0x10, idx)
+		default:
+			e.buf = appendHPACKInt(e.buf, 4, 0x00, idx)
+		}
+		if idx == 0 {
+			e.buf = appendHPACKString(e.buf, name, encoding.Huffman)
+		}
+		e.buf = appendHPACKString(e.buf, value, encoding.Huffman)
+	}
+
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// SetMaxDynamicTableSize changes the dynamic table size to v, bounded by
+// the limit set by the peer. The change is announced at the start of the
+// next header block.
+func (e *hpackEncoder) SetMaxDynamicTableSize(v uint32) {
+	if v > e.maxSizeLimit {
+		v = e.maxSizeLimit
+	}
+	if v < e.minSize {
+		e.minSize = v
+	}
+	e.tableSizeUpdate = true
+	e.setMaxSize(v)
+}
+
+// SetMaxDynamicTableSizeLimit changes the largest table size the peer
+// accepts, as sent in its SETTINGS_HEADER_TABLE_SIZE. The table follows it
+// up to the size the encoder was configured with.
+func (e *hpackEncoder) SetMaxDynamicTableSizeLimit(v uint32) {
+	e.maxSizeLimit = v
+
+	size := e.wantSize
+	if size > v {
+		size = v
+	}
+	if size != e.maxSize {
+		e.SetMaxDynamicTableSize(size)
+	}
+}
+
+// search returns the index of f in the static or dynamic table, and whether
+// the value matched as well. A name match in the static table wins over one
+// in the dynamic table. Sensitive fields only match by name.
+func (e *hpackEncoder) search(f hpack.HeaderField) (idx uint64, nameValueMatch bool) {
+	for i, entry := range hpackStaticTable {
+		if entry.Name != f.Name {
+			continue
+		}
+		if !f.Sensitive && entry.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		// like hpack.Encoder, the last static entry of a name is used
+		idx = uint64(i + 1)
+	}
+
+	for i, entry := range e.table {
+		if entry.Name != f.Name {
+			continue
+		}
+		dynIdx := uint64(len(hpackStaticTable) + i + 1)
+		if !f.Sensitive && entry.Value == f.Value {
+			return dynIdx, true
+		}
+		if idx == 0 {
+			idx = dynIdx
+		}
+	}
+	return idx, false
+}
+
+// add puts f at the front of the dynamic table, evicting old entries as
+// needed.
+func (e *hpackEncoder) add(f hpack.HeaderField) {
+	e.table = append([]hpack.HeaderField{f}, e.table...)
+	e.size += f.Size()
+	e.evict()
+}
+
+func (e *hpackEncoder) setMaxSize(v uint32) {
+	e.maxSize = v
+	e.evict()
+}
+
+func (e *hpackEncoder) evict() {
+	for e.size > e.maxSize && len(e.table) > 0 {
+		last := e.table[len(e.table)-1]
+		e.table = e.table[:len(e.table)-1]
+		e.size -= last.Size()
+	}
+}
+
+// appendHPACKInt appends i with an n bit prefix, the first byte or'ed with
+// mask, as described in section 5.1 of RFC 7541.
+func appendHPACKInt(dst []byte, n byte, mask byte, i uint64) []byte {
+	k := uint64((1 << n) - 1)
+	if i < k {
+		return append(dst, mask|byte(i))
+	}
+	dst = append(dst, mask|byte(k))
+	i -= k
+	for ; i >= 128; i >>= 7 {
+		dst = append(dst, byte(0x80|(i&0x7f)))
+	}
+	return append(dst, byte(i))
+}
+
+// appendHPACKString appends s as a string literal, Huffman encoded as mode
+// asks.
+func appendHPACKString(dst []byte, s string, mode HuffmanMode) []byte {
+	huffmanLength := hpack.HuffmanEncodeLength(s)
+	useHuffman := mode == HuffmanAlways || mode == HuffmanShortest && huffmanLength < uint64(len(s))
+	if !useHuffman {
+		dst = appendHPACKInt(dst, 7, 0, uint64(len(s)))
+		return append(dst, s...)
+	}
+	dst = appendHPACKInt(dst, 7, 0x80, huffmanLength)
+	return hpack.AppendHuffmanString(dst, s)
+}
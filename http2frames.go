@@ -6,6 +6,7 @@ import (
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
 	"io"
+	"math"
 	"net"
 	"sync"
 	"time"
@@ -36,7 +37,91 @@ var (
 //go:linkname stdlibNewClientConn golang.org/x/net/http2.(*Transport).newClientConn
 func stdlibNewClientConn(t *http2.Transport, c net.Conn, singleUse bool) (*ClientConn, error)
 
+// configuredConn is what is kept for a connection opened by a configured
+// transport.
+type configuredConn struct {
+	// settings the connection was opened with, it keeps them even if its
+	// transport is configured again or detached later on
+	settings *H2Settings
+
+	// enc encodes the header blocks of the connection if the settings
+	// ask for a custom encoding. The stdlib ClientConn only knows
+	// hpack.Encoder, so it lives here.
+	enc *hpackEncoder
+}
+
+// configuredConns holds the connections opened by configured transports
+// until their read loop ends.
+var configuredConns = struct {
+	sync.RWMutex
+	m map[*ClientConn]*configuredConn
+}{m: make(map[*ClientConn]*configuredConn)}
+
+// connSettings returns the settings cc was opened with, or nil if its
+// transport wasn't configured.
+func connSettings(cc *ClientConn) *H2Settings {
+	configuredConns.RLock()
+	defer configuredConns.RUnlock()
+
+	if conn := configuredConns.m[cc]; conn != nil {
+		return conn.settings
+	}
+	return nil
+}
+
+// connEncoder returns the encoder of cc, or nil if it uses cc.henc.
+func connEncoder(cc *ClientConn) *hpackEncoder {
+	configuredConns.RLock()
+	defer configuredConns.RUnlock()
+
+	if conn := configuredConns.m[cc]; conn != nil {
+		return conn.enc
+	}
+	return nil
+}
+
+// forgetConn drops what is kept for cc, once its read loop has ended.
+func forgetConn(cc *ClientConn) {
+	configuredConns.Lock()
+	delete(configuredConns.m, cc)
+	configuredConns.Unlock()
+
+	pendingPriorities.Lock()
+	delete(pendingPriorities.m, cc)
+	pendingPriorities.Unlock()
+}
+
+// stdlibH2Settings mirrors the preface golang.org/x/net/http2 writes for t,
+// for connections of transports that weren't configured.
+func stdlibH2Settings(t *http2.Transport) *H2Settings {
+	settings := &H2Settings{
+		ConnFlow:             1 << 30,
+		StreamFlow:           4 << 20,
+		InitialWindowSize:    65535,
+		MaxConcurrentStreams: 1000,
+		HeaderTableSize:      4096,
+		Settings: []http2.Setting{
+			{ID: http2.SettingEnablePush, Val: 0},
+			{ID: http2.SettingInitialWindowSize, Val: 4 << 20},
+		},
+	}
+	if max := maxHeaderListSize(t); max != 0 {
+		settings.MaxHeaderListSize = max
+		settings.Settings = append(settings.Settings, http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: max})
+	}
+	return settings
+}
+
+// patchedNewClientConn opens connections of configured transports with
+// their settings. Connections of other transports get the stdlib preface and
+// aren't registered, so the other patches treat them like the stdlib does.
 func patchedNewClientConn(t *http2.Transport, c net.Conn, singleUse bool) (*ClientConn, error) {
+	settings := h2SettingsFor(t)
+	configured := settings != nil
+	if !configured {
+		settings = stdlibH2Settings(t)
+	}
+
 	cc := &ClientConn{
 		t:                     t,
 		tconn:                 c,
@@ -44,7 +129,7 @@ func patchedNewClientConn(t *http2.Transport, c net.Conn, singleUse bool) (*Clie
 		nextStreamID:          1,
 		maxFrameSize:          16 << 10,           // spec default
 		initialWindowSize:     65535,              // spec default
-		maxConcurrentStreams:  MaxConcurrentStreams,                // "infinite", per spec. 1000 seems good enough.
+		maxConcurrentStreams:  settings.MaxConcurrentStreams,       // "infinite", per spec. 1000 seems good enough.
 		peerMaxHeaderListSize: 0xffffffffffffffff, // "infinite", per spec. Use 2^64-1 instead.
 		streams:               make(map[uint32]*clientStream),
 		singleUse:             singleUse,
@@ -53,7 +138,7 @@ func patchedNewClientConn(t *http2.Transport, c net.Conn, singleUse bool) (*Clie
 	}
 	if d := stdLibIdleConnTimeout(t); d != 0 {
 		cc.idleTimeout = d
-		cc.idleTimer = time.AfterFunc(d, onIdleTimeout)
+		cc.idleTimer = time.AfterFunc(d, func() { onIdleTimeout(cc) })
 	}
 	if http2.VerboseLogs {
 		vlogf(t, "http2: Transport creating client conn %p to %v", cc, c.RemoteAddr())
@@ -61,16 +146,21 @@ func patchedNewClientConn(t *http2.Transport, c net.Conn, singleUse bool) (*Clie
 
 	cc.cond = sync.NewCond(&cc.mu)
 
-	flowAdd(&cc.flow, int32(InitialWindowSize))
+	flowAdd(&cc.flow, int32(settings.InitialWindowSize))
 
 
 	cc.bw = bufio.NewWriter(stickyErrWriter{c, &cc.werr})
 	cc.br = bufio.NewReader(c)
 	cc.fr = http2.NewFramer(cc.bw, cc.br)
-	cc.fr.ReadMetaHeaders = hpack.NewDecoder(InitialHeaderTableSize, nil)
-	cc.fr.MaxHeaderListSize = MaxHeaderListSize
+	cc.fr.ReadMetaHeaders = hpack.NewDecoder(settings.settingValue(http2.SettingHeaderTableSize, 4096), nil)
+	cc.fr.MaxHeaderListSize = settings.settingValue(http2.SettingMaxHeaderListSize, 0)
 
 	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	conn := &configuredConn{settings: settings}
+	if settings.customEncoding() {
+		// unlike hpack.Encoder this one follows the table size of the peer
+		conn.enc = newHPACKEncoder(&cc.hbuf, settings)
+	}
 
 	if t.AllowHTTP {
 		cc.nextStreamID = 3
@@ -81,36 +171,62 @@ func patchedNewClientConn(t *http2.Transport, c net.Conn, singleUse bool) (*Clie
 		cc.tlsState = &state
 	}
 
-	initialSettings := []http2.Setting{
-		{ID: http2.SettingEnablePush, Val: SettingEnablePush},
-		{ID: http2.SettingInitialWindowSize, Val: TransportDefaultStreamFlow},
-		{ID: http2.SettingMaxConcurrentStreams, Val: MaxConcurrentStreams},
-		{ID: http2.SettingHeaderTableSize, Val: InitialHeaderTableSize},
-		{ID: http2.SettingMaxFrameSize, Val: MaxFrameSize},
-	}
-
-	initialSettings = append(initialSettings, http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: MaxHeaderListSize})
-
-	cc.bw.Write(clientPreface)
-	cc.fr.WriteSettings(initialSettings...)
-	cc.fr.WriteWindowUpdate(0, TransportDefaultConnFlow)
-
-	flowAdd(&cc.inflow, int32(TransportDefaultConnFlow+InitialWindowSize))
+	connWindow := writeClientPreface(cc.bw, cc.fr, settings, &cc.nextStreamID)
+	flowAdd(&cc.inflow, int32(connWindow))
 	cc.bw.Flush()
 	if cc.werr != nil {
 		return nil, cc.werr
 	}
 
-	go readLoop(cc)
+	if !configured {
+		go readLoop(cc)
+		return cc, nil
+	}
+
+	configuredConns.Lock()
+	configuredConns.m[cc] = conn
+	configuredConns.Unlock()
+
+	go func() {
+		readLoop(cc)
+		forgetConn(cc)
+	}()
 	return cc, nil
 }
 
+// writeClientPreface writes the preface, SETTINGS, WINDOW_UPDATE and
+// PRIORITY frames described by settings. nextStreamID is moved past the
+// streams used by the PRIORITY frames. It returns the receive window of the
+// connection once the frames have been sent.
+func writeClientPreface(w io.Writer, fr *http2.Framer, settings *H2Settings, nextStreamID *uint32) uint32 {
+	w.Write(clientPreface)
+	fr.WriteSettings(settings.initialSettings()...)
+
+	// the peer lets us receive InitialWindowSize bytes until told otherwise
+	connWindow := settings.InitialWindowSize
+	if settings.ConnFlow != 0 {
+		fr.WriteWindowUpdate(0, settings.ConnFlow)
+		connWindow += settings.ConnFlow
+	}
+
+	for _, frame := range settings.PriorityFrames {
+		fr.WritePriority(frame.StreamID, frame.PriorityParam)
+
+		// don't open a request stream on an id that is part of the tree
+		if frame.StreamID >= *nextStreamID {
+			*nextStreamID = frame.StreamID + 1
+			if *nextStreamID%2 == 0 {
+				*nextStreamID++
+			}
+		}
+	}
+
+	return connWindow
+}
+
 //go:linkname stdLibIdleConnTimeout golang.org/x/net/http2.(*Transport).idleConnTimeout
 func stdLibIdleConnTimeout(t *http2.Transport) time.Duration
 
-//go:linkname maxHeaderListSize golang.org/x/net/http2.(*Transport).maxHeaderListSize
-func maxHeaderListSize(t *http2.Transport) uint32
-
 //go:linkname vlogf golang.org/x/net/http2.(*Transport).vlogf
 func vlogf(t *http2.Transport, format string, args ...interface{})
 
@@ -118,7 +234,10 @@ func vlogf(t *http2.Transport, format string, args ...interface{})
 func readLoop(cc *ClientConn)
 
 //go:linkname onIdleTimeout golang.org/x/net/http2.(*ClientConn).onIdleTimeout
-func onIdleTimeout()
+func onIdleTimeout(cc *ClientConn)
+
+//go:linkname maxHeaderListSize golang.org/x/net/http2.(*Transport).maxHeaderListSize
+func maxHeaderListSize(t *http2.Transport) uint32
 
 //go:linkname flowAdd golang.org/x/net/http2.(*flow).add
 func flowAdd(f *flow, n int32) bool
@@ -139,4 +258,78 @@ func (sew stickyErrWriter) Write(p []byte) (n int, err error) {
 	n, err = sew.w.Write(p)
 	*sew.err = err
 	return
-}
\ No newline at end of file
+}
+type clientConnReadLoop struct {
+	cc            *ClientConn
+	closeWhenIdle bool
+}
+
+//go:linkname stdlibProcessSettings golang.org/x/net/http2.(*clientConnReadLoop).processSettings
+func stdlibProcessSettings(rl *clientConnReadLoop, f *http2.SettingsFrame) error
+
+// mostly YOINKED from http2's processSettings. Only adding
+// SETTINGS_HEADER_TABLE_SIZE for connections with an hpackEncoder, the
+// others are handled like the stdlib does
+func patchedProcessSettings(rl *clientConnReadLoop, f *http2.SettingsFrame) error {
+	cc := rl.cc
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if f.IsAck() {
+		if cc.wantSettingsAck {
+			cc.wantSettingsAck = false
+			return nil
+		}
+		return http2.ConnectionError(http2.ErrCodeProtocol)
+	}
+
+	err := f.ForeachSetting(func(s http2.Setting) error {
+		switch s.ID {
+		case http2.SettingMaxFrameSize:
+			cc.maxFrameSize = s.Val
+		case http2.SettingMaxConcurrentStreams:
+			cc.maxConcurrentStreams = s.Val
+		case http2.SettingMaxHeaderListSize:
+			cc.peerMaxHeaderListSize = uint64(s.Val)
+		case http2.SettingInitialWindowSize:
+			// Values above the maximum flow-control
+			// window size of 2^31-1 MUST be treated as a
+			// connection error (Section 5.4.1) of type
+			// FLOW_CONTROL_ERROR.
+			if s.Val > math.MaxInt32 {
+				return http2.ConnectionError(http2.ErrCodeFlowControl)
+			}
+
+			// Adjust flow control of currently-open
+			// frames by the difference of the old initial
+			// window size and this one.
+			delta := int32(s.Val) - int32(cc.initialWindowSize)
+			for _, cs := range cc.streams {
+				flowAdd(&cs.flow, delta)
+			}
+			cc.cond.Broadcast()
+
+			cc.initialWindowSize = s.Val
+		case http2.SettingHeaderTableSize:
+			if enc := connEncoder(cc); enc != nil {
+				enc.SetMaxDynamicTableSizeLimit(s.Val)
+				break
+			}
+			vlogf(cc.t, "Unhandled Setting: %v", s)
+		default:
+			vlogf(cc.t, "Unhandled Setting: %v", s)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	cc.fr.WriteSettingsAck()
+	cc.bw.Flush()
+	return cc.werr
+}
@@ -1,19 +1,96 @@
+// Package httpmod makes Go HTTP clients present the fingerprints of other
+// clients: the TLS ClientHello, the HTTP/2 connection preface and the order
+// and values of the headers. A Profile bundles them, NewClient returns a
+// client presenting one, and Apply patches the x/net HTTP/2 transports opted
+// in with ConfigureH2Transport.
+//
+// Profiles are stored as JSON, see LoadProfile. There is no YAML format: the
+// standard library has no YAML decoder, and a dependency only to read what
+// JSON already expresses didn't seem worth it.
 package httpmod
 
 import (
 	"bou.ke/monkey"
 	"net/http"
 	"reflect"
+	"sync"
 )
 
-var patchGuards []*monkey.PatchGuard
+var patches = struct {
+	sync.Mutex
+	refs   int
+	guards []*monkey.PatchGuard
 
-func Apply() {
+	// generation counts how often the patches were taken out, handles
+	// from before that no longer hold a reference
+	generation int
+}{}
+
+// Handle keeps the patches installed by Apply in place until it is removed.
+type Handle struct {
+	once       sync.Once
+	generation int
+}
+
+// Apply patches net/http and golang.org/x/net/http2. The HTTP/2 patches only
+// change the behavior of connections opened by transports opted in with
+// ConfigureH2Transport, other connections run copies of the patched
+// functions and behave like the stdlib ones. HTTP/1.1 headers are only
+// reordered for requests that ask for an order, see WithHeaderOrder, or when
+// DefaultHeaderOrder is set. Header value validation is disabled process
+// wide.
+//
+// Apply may be called any number of times. The patches are removed once
+// every returned Handle has been removed.
+func Apply() *Handle {
+	patches.Lock()
+	defer patches.Unlock()
+
+	patches.refs++
+	if patches.refs == 1 {
+		patch()
+	}
+	return &Handle{generation: patches.generation}
+}
+
+// Remove drops the reference h holds on the patches. Calling it more than
+// once has no further effect.
+func (h *Handle) Remove() {
+	h.once.Do(func() {
+		patches.Lock()
+		defer patches.Unlock()
+
+		if h.generation != patches.generation {
+			// already removed with the package level Remove
+			return
+		}
+		patches.refs--
+		if patches.refs == 0 {
+			unpatch()
+		}
+	})
+}
+
+// Remove takes out the patches right away, no matter how many handles are
+// still around. Removing those handles afterwards has no effect.
+func Remove() {
+	patches.Lock()
+	defer patches.Unlock()
+
+	if patches.refs == 0 {
+		return
+	}
+	patches.refs = 0
+	unpatch()
+}
+
+// patch installs the patches. patches must be locked.
+func patch() {
 	// disable header validation
 	guard := monkey.Patch(customHeaderValidation, func(s string) bool {
 		return true
 	})
-	patchGuards = append(patchGuards, guard)
+	patches.guards = append(patches.guards, guard)
 
 	req := http.Request{}
 
@@ -21,20 +98,38 @@ func Apply() {
 	guard = monkey.PatchInstanceMethod(reflect.TypeOf(req.Header), "Set", func(h http.Header, k, v string) {
 		h[k] = []string{v}
 	})
-	patchGuards = append(patchGuards, guard)
+	patches.guards = append(patches.guards, guard)
 
 	guard = monkey.Patch(stdlibHeaderWriteSubset, patchedHeaderWriteSubset)
-	patchGuards = append(patchGuards, guard)
+	patches.guards = append(patches.guards, guard)
 
-	guard = monkey.Patch(stdlibEncodeHeaders, patchedEncodeHeaders)
-	patchGuards = append(patchGuards, guard)
+	// let the header writer find the request it is writing
+	for _, p := range []struct{ target, replacement interface{} }{
+		{(*http.Transport).RoundTrip, patchedTransportRoundTrip},
+		{(*http.Request).Write, patchedRequestWrite},
+		{(*http.Request).WriteProxy, patchedRequestWriteProxy},
+	} {
+		patches.guards = append(patches.guards, monkey.Patch(p.target, p.replacement))
+	}
 
-	guard = monkey.Patch(stdlibNewClientConn, patchedNewClientConn)
-	patchGuards = append(patchGuards, guard)
+	// the HTTP/2 patches stay in place until unpatch, connections of
+	// transports that weren't configured are told apart inside them
+	for _, p := range []struct{ target, replacement interface{} }{
+		{stdlibEncodeHeaders, patchedEncodeHeaders},
+		{stdlibEncodeTrailers, patchedEncodeTrailers},
+		{stdlibNewClientConn, patchedNewClientConn},
+		{stdlibWriteHeaders, patchedWriteHeaders},
+		{stdlibProcessSettings, patchedProcessSettings},
+	} {
+		patches.guards = append(patches.guards, monkey.Patch(p.target, p.replacement))
+	}
 }
 
-func Remove() {
-	for _, guard := range patchGuards {
+// unpatch removes the patches. patches must be locked.
+func unpatch() {
+	for _, guard := range patches.guards {
 		guard.Unpatch()
 	}
+	patches.guards = nil
+	patches.generation++
 }
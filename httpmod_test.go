@@ -0,0 +1,423 @@
+package httpmod
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestHandleAfterRemove(t *testing.T) {
+	old := Apply()
+	Remove()
+
+	h := Apply()
+	defer h.Remove()
+
+	// old lost its reference to the package level Remove
+	old.Remove()
+	if patches.refs != 1 || patches.guards == nil {
+		t.Fatalf("removing a stale handle took out the patches of a live one: refs = %d", patches.refs)
+	}
+
+	h.Remove()
+	h.Remove()
+	if patches.refs != 0 || patches.guards != nil {
+		t.Fatalf("patches still in place after the last handle was removed: refs = %d", patches.refs)
+	}
+}
+
+// recordingConn keeps a copy of everything written to it.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+func TestPatchedTransports(t *testing.T) {
+	h := Apply()
+	defer h.Remove()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Test"))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	firefox, _ := ProfileByName("firefox_65")
+	tests := []struct {
+		name     string
+		settings *H2Settings
+		akamai   string
+	}{
+		{
+			// left alone, the transport must behave like the stdlib one
+			name:   "unconfigured",
+			akamai: "2:0;4:4194304;6:10485760|1073741824|0|a,m,p,s",
+		},
+		{
+			name:     "configured",
+			settings: firefox.h2Settings(),
+			akamai:   "1:65536;4:131072;5:16384|12517377|3:0:0:201,5:0:0:101,7:0:0:1,9:0:7:1,11:0:3:1,13:0:0:241|m,p,a,s",
+		},
+	}
+
+	for _, test := range tests {
+		var conn *recordingConn
+		tr := &http2.Transport{
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				c, err := tls.Dial(network, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+				if err != nil {
+					return nil, err
+				}
+				conn = &recordingConn{Conn: c}
+				return conn, nil
+			},
+		}
+		if test.settings != nil {
+			ConfigureH2Transport(tr, test.settings)
+		}
+
+		// the second request reuses the HPACK state of the first
+		for i, value := range []string{"first", "second"} {
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			req.Header.Set("X-Test", value)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("%s: request %d: %v", test.name, i, err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != value {
+				t.Errorf("%s: request %d: server saw X-Test %q, want %q", test.name, i, body, value)
+			}
+		}
+
+		akamai, err := AkamaiFingerprint(conn.Written())
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if akamai != test.akamai {
+			t.Errorf("%s: Akamai = %s, want %s", test.name, akamai, test.akamai)
+		}
+
+		tr.CloseIdleConnections()
+		ConfigureH2Transport(tr, nil)
+		waitConnsForgotten(t)
+	}
+}
+
+func TestConfiguredTransportTrailers(t *testing.T) {
+	h := Apply()
+	defer h.Remove()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		io.WriteString(w, r.Header.Get("X-Test")+","+r.Trailer.Get("X-Trailer"))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	firefox, _ := ProfileByName("firefox_65")
+	custom := firefox.h2Settings()
+	custom.HeaderEncodings = map[string]HeaderEncoding{"x-test": {Huffman: HuffmanNever}}
+
+	for _, settings := range []*H2Settings{firefox.h2Settings(), custom} {
+		tr := &http2.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		ConfigureH2Transport(tr, settings)
+
+		// trailers land in the dynamic table of the peer, the requests
+		// after them only decode if the encoder saw them as well
+		for i := 0; i < 3; i++ {
+			value := strings.Repeat("v", i+1)
+			req, _ := http.NewRequest("POST", server.URL, strings.NewReader("body"))
+			req.Header.Set("X-Test", value)
+			req.Trailer = http.Header{"X-Trailer": {value}}
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("custom encoding %v: request %d: %v", settings.customEncoding(), i, err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if want := value + "," + value; string(body) != want {
+				t.Errorf("custom encoding %v: request %d: server saw %q, want %q", settings.customEncoding(), i, body, want)
+			}
+		}
+
+		configuredConns.RLock()
+		for _, conn := range configuredConns.m {
+			if (conn.enc != nil) != settings.customEncoding() {
+				t.Errorf("custom encoding %v: connection has an encoder of its own: %v", settings.customEncoding(), conn.enc != nil)
+			}
+		}
+		configuredConns.RUnlock()
+
+		tr.CloseIdleConnections()
+		ConfigureH2Transport(tr, nil)
+		waitConnsForgotten(t)
+	}
+}
+
+// waitConnsForgotten waits for the read loops of closed connections to end.
+func waitConnsForgotten(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		configuredConns.RLock()
+		n := len(configuredConns.m)
+		configuredConns.RUnlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still kept after closing them", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// settingsServer is a plain text HTTP/2 server that sends a SETTINGS frame
+// whenever the HEADERS of a request arrive, while the client may be encoding
+// the next one. It records the SETTINGS each connection opened with and the
+// pseudo header order of each request.
+type settingsServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	settings []string
+	pseudo   []string
+}
+
+func newSettingsServer(t *testing.T) *settingsServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &settingsServer{l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *settingsServer) serve(c net.Conn) {
+	defer c.Close()
+
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(c, preface); err != nil {
+		return
+	}
+	fr := http2.NewFramer(c, c)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	fr.WriteSettings()
+
+	var hbuf bytes.Buffer
+	henc := hpack.NewEncoder(&hbuf)
+	seenSettings := false
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() || seenSettings {
+				continue
+			}
+			seenSettings = true
+			var settings []string
+			f.ForeachSetting(func(setting http2.Setting) error {
+				settings = append(settings, fmt.Sprintf("%d:%d", setting.ID, setting.Val))
+				return nil
+			})
+			s.mu.Lock()
+			s.settings = append(s.settings, strings.Join(settings, ";"))
+			s.mu.Unlock()
+			fr.WriteSettingsAck()
+		case *http2.MetaHeadersFrame:
+			var pseudo []string
+			for _, field := range f.PseudoFields() {
+				pseudo = append(pseudo, field.Name)
+			}
+			s.mu.Lock()
+			s.pseudo = append(s.pseudo, strings.Join(pseudo, ","))
+			s.mu.Unlock()
+
+			for i := 0; i < 3; i++ {
+				fr.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100})
+			}
+			hbuf.Reset()
+			henc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      f.StreamID,
+				BlockFragment: hbuf.Bytes(),
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+		}
+	}
+}
+
+// check reports the connections and requests that didn't present settings
+// and pseudo.
+func (s *settingsServer) check(t *testing.T, name, settings, pseudo string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, got := range s.settings {
+		if got != settings {
+			t.Errorf("%s: connection opened with SETTINGS %s, want %s", name, got, settings)
+			break
+		}
+	}
+	for _, got := range s.pseudo {
+		if got != pseudo {
+			t.Errorf("%s: request sent pseudo headers %s, want %s", name, got, pseudo)
+			break
+		}
+	}
+}
+
+func TestConcurrentTransportsWithSettingsMidRequest(t *testing.T) {
+	h := Apply()
+	defer h.Remove()
+
+	stdlibServer := newSettingsServer(t)
+	defer stdlibServer.l.Close()
+	configuredServer := newSettingsServer(t)
+	defer configuredServer.l.Close()
+
+	dial := func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	stdlib := &http2.Transport{AllowHTTP: true, DialTLS: dial}
+	configured := &http2.Transport{AllowHTTP: true, DialTLS: dial}
+	firefox, _ := ProfileByName("firefox_65")
+	ConfigureH2Transport(configured, firefox.h2Settings())
+	defer ConfigureH2Transport(configured, nil)
+
+	// a configured request sent while a stdlib one is stalled in the middle
+	// of its HEADERS must still go out as configured
+	wrote, resume := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	trace := &httptrace.ClientTrace{
+		WroteHeaderField: func(string, []string) {
+			once.Do(func() {
+				close(wrote)
+				<-resume
+			})
+		},
+	}
+	stalled := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+stdlibServer.l.Addr().String()+"/", nil)
+		resp, err := stdlib.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err == nil {
+			resp.Body.Close()
+		}
+		stalled <- err
+	}()
+	<-wrote
+	sent := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+configuredServer.l.Addr().String()+"/", nil)
+		resp, err := configured.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("configured request stuck behind a stalled stdlib one")
+	}
+	close(resume)
+	if err := <-stalled; err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var wg sync.WaitGroup
+		for _, client := range []struct {
+			tr   *http2.Transport
+			addr string
+		}{
+			{stdlib, stdlibServer.l.Addr().String()},
+			{configured, configuredServer.l.Addr().String()},
+		} {
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func(tr *http2.Transport, addr string, i int) {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+						req.Header.Set("Cookie", "a=1; b=2")
+						// make some requests open new connections
+						if (i+j)%4 == 0 {
+							tr.CloseIdleConnections()
+						}
+						resp, err := tr.RoundTrip(req)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						resp.Body.Close()
+					}
+				}(client.tr, client.addr, i)
+			}
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("requests are stuck")
+	}
+	stdlib.CloseIdleConnections()
+	configured.CloseIdleConnections()
+
+	stdlibServer.check(t, "stdlib", "2:0;4:4194304;6:10485760", ":authority,:method,:path,:scheme")
+	configuredServer.check(t, "configured", "1:65536;4:131072;5:16384", ":method,:path,:authority,:scheme")
+}
@@ -0,0 +1,246 @@
+package httpmod
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	utls "gitlab.com/yawning/utls.git"
+)
+
+// ja3SignatureAlgorithms are sent for the signature_algorithms extension, a
+// JA3 string only says the extension is there. They are the ones of Chrome.
+var ja3SignatureAlgorithms = []utls.SignatureScheme{
+	0x0403, // ecdsa_secp256r1_sha256
+	0x0804, // rsa_pss_rsae_sha256
+	0x0401, // rsa_pkcs1_sha256
+	0x0503, // ecdsa_secp384r1_sha384
+	0x0805, // rsa_pss_rsae_sha384
+	0x0501, // rsa_pkcs1_sha384
+	0x0806, // rsa_pss_rsae_sha512
+	0x0601, // rsa_pkcs1_sha512
+}
+
+// ParseJA3 returns a ClientHelloSpec that has the JA3 fingerprint ja3, e.g.
+// "771,4865-4866-4867,0-23-65281-10-11-35-16,29-23-24,0". GREASE values in
+// the string are sent as GREASE.
+//
+// JA3 only records which extensions are sent, so their contents are made
+// up: ALPN offers h2 and http/1.1, supported_versions TLS 1.3 down to 1.0,
+// the signature algorithms are those of Chrome and the key share is for the
+// first curve uTLS can make one for, ParseJA3 fails if there is none.
+// Extensions uTLS has no type for, like encrypt_then_mac (22), can't be sent
+// and make ParseJA3 fail.
+//
+// The spec keeps state once it is used, call ParseJA3 for every connection,
+// e.g. from Profile.ClientHelloSpec.
+func ParseJA3(ja3 string) (*utls.ClientHelloSpec, error) {
+	fields := strings.Split(ja3, ",")
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid JA3 %q: expected 5 fields, got %d", ja3, len(fields))
+	}
+
+	version, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JA3 version %q", fields[0])
+	}
+	ciphers, err := parseJA3List("cipher", fields[1])
+	if err != nil {
+		return nil, err
+	}
+	extensions, err := parseJA3List("extension", fields[2])
+	if err != nil {
+		return nil, err
+	}
+	curveValues, err := parseJA3List("curve", fields[3])
+	if err != nil {
+		return nil, err
+	}
+	pointFormats, err := parseJA3List("point format", fields[4])
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphers) == 0 {
+		return nil, fmt.Errorf("invalid JA3 %q: no cipher suites", ja3)
+	}
+
+	spec := &utls.ClientHelloSpec{
+		TLSVersMin:         0x0301,
+		TLSVersMax:         uint16(version),
+		CompressionMethods: []uint8{0},
+	}
+	if spec.TLSVersMax < spec.TLSVersMin {
+		spec.TLSVersMin = spec.TLSVersMax
+	}
+	for _, cipher := range ciphers {
+		if isGREASE(cipher) {
+			cipher = utls.GREASE_PLACEHOLDER
+		}
+		spec.CipherSuites = append(spec.CipherSuites, cipher)
+	}
+
+	var curves []utls.CurveID
+	for _, curve := range curveValues {
+		if isGREASE(curve) {
+			curve = utls.GREASE_PLACEHOLDER
+		}
+		curves = append(curves, utls.CurveID(curve))
+	}
+	var points []uint8
+	for _, format := range pointFormats {
+		if format > 0xff {
+			return nil, fmt.Errorf("invalid JA3 point format %d", format)
+		}
+		points = append(points, uint8(format))
+	}
+
+	seen := make(map[uint16]bool)
+	for _, id := range extensions {
+		if seen[id] && !isGREASE(id) {
+			return nil, fmt.Errorf("invalid JA3 %q: extension %d is listed twice", ja3, id)
+		}
+		seen[id] = true
+
+		if id == 43 {
+			// legacy_version stays at TLS 1.2, the real one is negotiated here
+			spec.TLSVersMax = 0x0304
+		}
+		ext, err := ja3Extension(id, curves, points)
+		if err != nil {
+			return nil, err
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+	return spec, nil
+}
+
+func parseJA3List(kind, field string) ([]uint16, error) {
+	if field == "" {
+		return nil, nil
+	}
+	var values []uint16
+	for _, s := range strings.Split(field, "-") {
+		v, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JA3 %s %q", kind, s)
+		}
+		values = append(values, uint16(v))
+	}
+	return values, nil
+}
+
+// ja3Extension returns the extension id, filled in with curves and points
+// where it takes them.
+func ja3Extension(id uint16, curves []utls.CurveID, points []uint8) (utls.TLSExtension, error) {
+	if isGREASE(id) {
+		return &utls.UtlsGREASEExtension{}, nil
+	}
+
+	switch id {
+	case 0:
+		return &utls.SNIExtension{}, nil
+	case 5:
+		return &utls.StatusRequestExtension{}, nil
+	case 10:
+		return &utls.SupportedCurvesExtension{Curves: curves}, nil
+	case 11:
+		return &utls.SupportedPointsExtension{SupportedPoints: points}, nil
+	case 13:
+		return &utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: ja3SignatureAlgorithms}, nil
+	case 16:
+		return &utls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}}, nil
+	case 18:
+		return &utls.SCTExtension{}, nil
+	case 21:
+		return &utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle}, nil
+	case 23:
+		return &utls.UtlsExtendedMasterSecretExtension{}, nil
+	case 27:
+		return &utls.CompressCertificateExtension{Algorithms: []utls.CertCompressionAlgo{utls.CertCompressionBrotli}}, nil
+	case 28:
+		return &utls.FakeRecordSizeLimitExtension{Limit: 0x4001}, nil
+	case 35:
+		return &utls.SessionTicketExtension{}, nil
+	case 43:
+		return &utls.SupportedVersionsExtension{Versions: []uint16{0x0304, 0x0303, 0x0302, 0x0301}}, nil
+	case 45:
+		return &utls.PSKKeyExchangeModesExtension{Modes: []uint8{1}}, nil // psk_dhe_ke
+	case 51:
+		shares, err := ja3KeyShares(curves)
+		if err != nil {
+			return nil, err
+		}
+		return &utls.KeyShareExtension{KeyShares: shares}, nil
+	case 30032:
+		return &utls.FakeChannelIDExtension{}, nil
+	case 65281:
+		return renegotiationInfoExtension(), nil
+	default:
+		return nil, fmt.Errorf("JA3 extension %d is not supported by uTLS", id)
+	}
+}
+
+// ja3KeyShares returns a key share for the first curve uTLS can make one
+// for, preceded by a GREASE one if the curves are GREASEd. A key share for a
+// curve the ClientHello doesn't offer would be rejected by servers, so it
+// fails if there is no such curve.
+func ja3KeyShares(curves []utls.CurveID) ([]utls.KeyShare, error) {
+	var shares []utls.KeyShare
+	for _, curve := range curves {
+		switch curve {
+		case utls.GREASE_PLACEHOLDER:
+			if len(shares) == 0 {
+				shares = append(shares, utls.KeyShare{Group: curve, Data: []byte{0}})
+			}
+		case utls.X25519, utls.CurveP256, utls.CurveP384, utls.CurveP521:
+			return append(shares, utls.KeyShare{Group: curve}), nil
+		}
+	}
+	return nil, fmt.Errorf("JA3 extension 51 needs a curve uTLS can make a key share for, one of 29, 23, 24 and 25")
+}
+
+// isGREASE reports whether v is one of the GREASE values of RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello clientHello, a
+// handshake message with or without its record header.
+func JA3(clientHello []byte) (string, error) {
+	hello, err := parseClientHello(clientHello)
+	if err != nil {
+		return "", err
+	}
+
+	points := make([]uint16, len(hello.pointFormats))
+	for i, format := range hello.pointFormats {
+		points[i] = uint16(format)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(hello.version)),
+		joinJA3List(hello.cipherSuites),
+		joinJA3List(hello.extensions),
+		joinJA3List(hello.curves),
+		joinJA3List(points),
+	}, ","), nil
+}
+
+// JA3Hash returns the hash of the JA3 fingerprint ja3, as used by most
+// tools that match on JA3.
+func JA3Hash(ja3 string) string {
+	sum := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(sum[:])
+}
+
+// joinJA3List joins values with dashes, leaving out GREASE.
+func joinJA3List(values []uint16) string {
+	var s []string
+	for _, v := range values {
+		if !isGREASE(v) {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(s, "-")
+}
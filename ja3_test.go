@@ -0,0 +1,222 @@
+package httpmod
+
+import (
+	"bufio"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	utls "gitlab.com/yawning/utls.git"
+)
+
+func TestParseJA3(t *testing.T) {
+	tests := []struct {
+		ja3  string
+		want string // JA3 of the ClientHello the spec makes
+	}{
+		{
+			ja3:  "771,4865-4866-4867-49195-49199,0-23-65281-10-11-35-16-5-13-51-45-43,29-23-24,0",
+			want: "771,4865-4866-4867-49195-49199,0-23-65281-10-11-35-16-5-13-51-45-43,29-23-24,0",
+		},
+		{
+			// GREASE may repeat and is left out of the JA3 of the result
+			ja3:  "771,2570-4865-4866-49195,2570-0-23-10-11-16-13-51-45-43-2570,2570-29-23,0",
+			want: "771,4865-4866-49195,0-23-10-11-16-13-51-45-43,29-23,0",
+		},
+		{
+			ja3:  "771,49195-49199-52393-52392-49171-49172-156-157-47-53-10,65281-0-23-35-13-5-18-16-30032-11-10,29-23-24,0",
+			want: "771,49195-49199-52393-52392-49171-49172-156-157-47-53-10,65281-0-23-35-13-5-18-16-30032-11-10,29-23-24,0",
+		},
+		{
+			// the key share is for P-384, the only curve offered
+			ja3:  "771,4865-4866,0-10-11-51-43,24,0",
+			want: "771,4865-4866,0-10-11-51-43,24,0",
+		},
+		{
+			ja3:  "771,4865-4867-4866-49195,0-23-65281-10-11-35-16-5-51-43-13-45-28,29-23-24-25,0-1-2",
+			want: "771,4865-4867-4866-49195,0-23-65281-10-11-35-16-5-51-43-13-45-28,29-23-24-25,0-1-2",
+		},
+	}
+
+	for _, test := range tests {
+		spec, err := ParseJA3(test.ja3)
+		if err != nil {
+			t.Errorf("ParseJA3(%q): %v", test.ja3, err)
+			continue
+		}
+		hello, err := marshalClientHello("example.com", nil, nil, func() *utls.ClientHelloSpec { return spec })
+		if err != nil {
+			t.Errorf("ParseJA3(%q): marshal: %v", test.ja3, err)
+			continue
+		}
+		got, err := JA3(hello)
+		if err != nil {
+			t.Errorf("ParseJA3(%q): JA3: %v", test.ja3, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseJA3(%q) sends JA3\n%s\nwant\n%s", test.ja3, got, test.want)
+		}
+	}
+}
+
+func TestParseJA3KeyShares(t *testing.T) {
+	tests := []struct {
+		curves string
+		want   []utls.CurveID
+	}{
+		{"29-23-24", []utls.CurveID{utls.X25519}},
+		{"23-29", []utls.CurveID{utls.CurveP256}},
+		{"30-24-23", []utls.CurveID{utls.CurveP384}},
+		{"25", []utls.CurveID{utls.CurveP521}},
+		{"2570-30-29", []utls.CurveID{utls.GREASE_PLACEHOLDER, utls.X25519}},
+	}
+
+	for _, test := range tests {
+		spec, err := ParseJA3("771,4865,10-51," + test.curves + ",0")
+		if err != nil {
+			t.Errorf("curves %s: %v", test.curves, err)
+			continue
+		}
+		var got []utls.CurveID
+		for _, share := range spec.Extensions[1].(*utls.KeyShareExtension).KeyShares {
+			got = append(got, share.Group)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("curves %s: got key shares for %v, want %v", test.curves, got, test.want)
+		}
+	}
+}
+
+func TestParseJA3Errors(t *testing.T) {
+	tests := []struct {
+		ja3  string
+		want string
+	}{
+		{"771,4865,0-10,29,0,1", "expected 5 fields"},
+		{"771,4865,0", "expected 5 fields"},
+		{"tls,4865,0,29,0", "invalid JA3 version"},
+		{"771,,0,29,0", "no cipher suites"},
+		{"771,4865-x,0,29,0", "invalid JA3 cipher"},
+		{"771,4865,0-10-0,29,0", "extension 0 is listed twice"},
+		{"771,4865,0-22,29,0", "extension 22 is not supported"},
+		{"771,4865,0-70000,29,0", "invalid JA3 extension"},
+		{"771,4865,0-10,29-,0", "invalid JA3 curve"},
+		{"771,4865,0-11,29,256", "invalid JA3 point format"},
+		// no curve uTLS can make a key share for
+		{"771,4865,0-10-51,30,0", "needs a curve"},
+		{"771,4865,0-10-51,2570,0", "needs a curve"},
+		{"771,4865,0-51,,0", "needs a curve"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseJA3(test.ja3)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ParseJA3(%q) = %v, want an error containing %q", test.ja3, err, test.want)
+		}
+	}
+}
+
+// helloListener records the first TLS record of every connection it accepts.
+type helloListener struct {
+	net.Listener
+	hellos chan []byte
+}
+
+func (l helloListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		br := bufio.NewReader(conn)
+		header, err := br.Peek(5)
+		if err != nil {
+			// the client hung up without a ClientHello
+			conn.Close()
+			continue
+		}
+		record, err := br.Peek(5 + (int(header[3])<<8 | int(header[4])))
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		l.hellos <- append([]byte(nil), record...)
+		return bufferedConn{conn, br}, nil
+	}
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func TestNewUTLSRoundTripperWithSpec(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	hellos := make(chan []byte, 4)
+	server.Listener = helloListener{server.Listener, hellos}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := []string{
+		"771,4865-4866-4867-49195-49199,0-23-65281-10-11-35-16-5-13-51-45-43,29-23-24,0",
+		"771,49195-49199-52393-52392-49171-49172-156-157-47-53-10,65281-0-23-35-13-5-18-16-11-10,29-23-24,0",
+	}
+
+	for _, ja3 := range tests {
+		calls := 0
+		rt, err := NewUTLSRoundTripperWithSpec(func() *utls.ClientHelloSpec {
+			calls++
+			spec, err := ParseJA3(ja3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return spec
+		}, &utls.Config{RootCAs: roots, ServerName: "example.com"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the second request needs a new connection, and a new spec
+		for i := 0; i < 2; i++ {
+			resp, err := rt.RoundTrip(mustRequest(t, "GET", server.URL, nil))
+			if err != nil {
+				t.Fatalf("%s: request %d: %v", ja3, i, err)
+			}
+			resp.Body.Close()
+			rt.(*UTLSRoundTripper).CloseIdleConnections()
+
+			got, err := JA3(<-hellos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != ja3 {
+				t.Errorf("request %d sent JA3\n%s\nwant\n%s", i, got, ja3)
+			}
+		}
+		if calls != 2 {
+			t.Errorf("%s: the spec was made %d times for 2 connections", ja3, calls)
+		}
+	}
+
+	if _, err := NewUTLSRoundTripperWithSpec(nil, nil, nil); err == nil {
+		t.Error("NewUTLSRoundTripperWithSpec accepted a nil spec func")
+	}
+	rt, err := NewUTLSRoundTripperWithSpec(func() *utls.ClientHelloSpec { return nil }, &utls.Config{RootCAs: roots}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.RoundTrip(mustRequest(t, "GET", server.URL, nil)); err == nil {
+		t.Error("request with a nil spec succeeded")
+	}
+}
@@ -0,0 +1,123 @@
+package httpmod
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// JA4 returns the JA4 fingerprint of the ClientHello clientHello, a
+// handshake message with or without its record header, as sent over TCP.
+func JA4(clientHello []byte) (string, error) {
+	hello, err := parseClientHello(clientHello)
+	if err != nil {
+		return "", err
+	}
+
+	version := hello.version
+	if len(hello.supportedVersions) > 0 {
+		// legacy_version no longer counts once supported_versions is sent
+		version = 0
+		for _, v := range hello.supportedVersions {
+			if !isGREASE(v) && v > version {
+				version = v
+			}
+		}
+	}
+
+	sni := "i"
+	if hello.serverName {
+		sni = "d"
+	}
+
+	var ciphers, extensions []string
+	for _, cipher := range hello.cipherSuites {
+		if !isGREASE(cipher) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", cipher))
+		}
+	}
+	var extensionCount int
+	for _, id := range hello.extensions {
+		if isGREASE(id) {
+			continue
+		}
+		extensionCount++
+		// the SNI and ALPN extensions are already counted in the first part
+		if id != 0 && id != 16 {
+			extensions = append(extensions, fmt.Sprintf("%04x", id))
+		}
+	}
+	var algorithms []string
+	for _, algorithm := range hello.signatureAlgorithms {
+		if !isGREASE(algorithm) {
+			algorithms = append(algorithms, fmt.Sprintf("%04x", algorithm))
+		}
+	}
+
+	sort.Strings(ciphers)
+	sort.Strings(extensions)
+	extensionsPart := strings.Join(extensions, ",")
+	if len(algorithms) > 0 {
+		extensionsPart += "_" + strings.Join(algorithms, ",")
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, min99(len(ciphers)), min99(extensionCount), ja4ALPN(hello.alpnProtocols))
+	b := ja4Hash(strings.Join(ciphers, ","), len(ciphers) == 0)
+	c := ja4Hash(extensionsPart, len(extensions) == 0)
+	return a + "_" + b + "_" + c, nil
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last character of the first ALPN protocol,
+// or "00" without one.
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+	p := protocols[0]
+	first, last := p[0], p[len(p)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		// use the hex digits on the outside instead
+		return fmt.Sprintf("%x", first>>4) + fmt.Sprintf("%x", last&0x0f)
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// ja4Hash returns the truncated SHA-256 of s, or zeros if there was
+// nothing to hash.
+func ja4Hash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
@@ -0,0 +1,189 @@
+package httpmod
+
+import (
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// OrderedHeader is an http.Header that remembers the order its keys were
+// added in, and the casing they should have on the wire. Values are stored
+// under the canonical key, so http.Header methods keep working after a
+// conversion; the casing is kept in HeaderOrderKey.
+type OrderedHeader http.Header
+
+// FromHeader returns an OrderedHeader holding a copy of h. If h carries
+// HeaderOrderKey that order is kept. Keys it doesn't mention follow, ordered
+// by name like net/http would send them.
+func FromHeader(h http.Header) OrderedHeader {
+	oh := make(OrderedHeader, len(h))
+	for _, key := range h[HeaderOrderKey] {
+		if oh.index(key) >= 0 {
+			continue
+		}
+		values, _ := lookupHeader(h, key)
+		for _, value := range values {
+			oh.Add(key, value)
+		}
+	}
+
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		if key != HeaderOrderKey && key != PseudoHeaderOrderKey && oh.index(key) < 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range h[key] {
+			oh.Add(key, value)
+		}
+	}
+
+	if order, ok := h[PseudoHeaderOrderKey]; ok {
+		oh.SetPseudoHeaderOrder(order...)
+	}
+	return oh
+}
+
+// Header returns the fields of oh as an http.Header, without the order, so
+// that the order keys can't end up on the wire. Use Attach to send a
+// request with the headers in order. Values are shared with oh.
+func (oh OrderedHeader) Header() http.Header {
+	h := make(http.Header, len(oh))
+	for key, values := range oh {
+		if key != HeaderOrderKey && key != PseudoHeaderOrderKey {
+			h[key] = values
+		}
+	}
+	return h
+}
+
+// Add adds value to key. A key that is new goes to the end of the order with
+// the given casing, an existing one keeps its place and casing.
+func (oh OrderedHeader) Add(key, value string) {
+	if oh.index(key) < 0 {
+		oh[HeaderOrderKey] = append(oh[HeaderOrderKey], key)
+	}
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	oh[key] = append(oh[key], value)
+}
+
+// Set replaces the values of key by value. An existing key keeps its place
+// in the order but takes on the casing given here, a new one goes to the
+// end.
+func (oh OrderedHeader) Set(key, value string) {
+	if i := oh.index(key); i >= 0 {
+		oh[HeaderOrderKey][i] = key
+	} else {
+		oh[HeaderOrderKey] = append(oh[HeaderOrderKey], key)
+	}
+	oh[textproto.CanonicalMIMEHeaderKey(key)] = []string{value}
+}
+
+// Get returns the first value of key, or "" if there is none.
+func (oh OrderedHeader) Get(key string) string {
+	return http.Header(oh).Get(key)
+}
+
+// Values returns all values of key.
+func (oh OrderedHeader) Values(key string) []string {
+	return oh[textproto.CanonicalMIMEHeaderKey(key)]
+}
+
+// Del removes key and its place in the order.
+func (oh OrderedHeader) Del(key string) {
+	if i := oh.index(key); i >= 0 {
+		order := oh[HeaderOrderKey]
+		oh[HeaderOrderKey] = append(order[:i:i], order[i+1:]...)
+	}
+	delete(oh, textproto.CanonicalMIMEHeaderKey(key))
+}
+
+// Keys returns the keys in order, with their wire casing.
+func (oh OrderedHeader) Keys() []string {
+	return append([]string(nil), oh[HeaderOrderKey]...)
+}
+
+// Clone returns a deep copy of oh.
+func (oh OrderedHeader) Clone() OrderedHeader {
+	clone := make(OrderedHeader, len(oh))
+	for key, values := range oh {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// InsertBefore sets key to value and places it right before mark. If mark
+// isn't present key goes to the end.
+func (oh OrderedHeader) InsertBefore(mark, key, value string) {
+	oh.insert(mark, key, value, 0)
+}
+
+// InsertAfter sets key to value and places it right after mark. If mark
+// isn't present key goes to the end.
+func (oh OrderedHeader) InsertAfter(mark, key, value string) {
+	oh.insert(mark, key, value, 1)
+}
+
+// MoveToFront places key first in the order. It does nothing if key isn't
+// present.
+func (oh OrderedHeader) MoveToFront(key string) {
+	i := oh.index(key)
+	if i < 0 {
+		return
+	}
+	order := oh[HeaderOrderKey]
+	name := order[i]
+	copy(order[1:i+1], order[:i])
+	order[0] = name
+}
+
+// Attach returns a shallow copy of req that sends the headers of oh in
+// order. The order is carried by the context of the copy, see
+// WithHeaderOrder, and left out of its header map.
+func (oh OrderedHeader) Attach(req *http.Request) *http.Request {
+	ctx := WithHeaderOrder(req.Context(), oh[HeaderOrderKey]...)
+	if order, ok := oh[PseudoHeaderOrderKey]; ok {
+		ctx = WithPseudoHeaderOrder(ctx, order...)
+	}
+	req = req.WithContext(ctx)
+	req.Header = oh.Header()
+	return req
+}
+
+// SetPseudoHeaderOrder sets the order of the HTTP/2 pseudo headers, e.g.
+// ":method", ":authority", ":scheme", ":path" like Chrome does.
+func (oh OrderedHeader) SetPseudoHeaderOrder(order ...string) {
+	oh[PseudoHeaderOrderKey] = order
+}
+
+// insert sets key to value and places it at the position of mark plus
+// offset.
+func (oh OrderedHeader) insert(mark, key, value string, offset int) {
+	oh.Del(key)
+	oh[textproto.CanonicalMIMEHeaderKey(key)] = []string{value}
+
+	order := oh[HeaderOrderKey]
+	i := oh.index(mark)
+	if i < 0 {
+		oh[HeaderOrderKey] = append(order, key)
+		return
+	}
+	i += offset
+	order = append(order, "")
+	copy(order[i+1:], order[i:])
+	order[i] = key
+	oh[HeaderOrderKey] = order
+}
+
+// index returns the position of key in the order, or -1.
+func (oh OrderedHeader) index(key string) int {
+	for i, name := range oh[HeaderOrderKey] {
+		if strings.EqualFold(name, key) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,128 @@
+package httpmod
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOrderedHeader(t *testing.T) {
+	h := Apply()
+	defer h.Remove()
+
+	oh := make(OrderedHeader)
+	oh.Add("X-B", "b")
+	oh.Add("X-A", "a")
+	oh.InsertBefore("X-B", "X-C", "c")
+	oh.SetPseudoHeaderOrder(":method", ":path", ":authority", ":scheme")
+
+	header := oh.Header()
+	if _, ok := header[HeaderOrderKey]; ok {
+		t.Errorf("Header() kept %s", HeaderOrderKey)
+	}
+	if _, ok := header[PseudoHeaderOrderKey]; ok {
+		t.Errorf("Header() kept %s", PseudoHeaderOrderKey)
+	}
+	if header.Get("X-A") != "a" || len(header) != 3 {
+		t.Errorf("Header() = %v, want the three fields", header)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req = oh.Attach(req)
+	if _, ok := req.Header[HeaderOrderKey]; ok {
+		t.Errorf("Attach left %s in the header map", HeaderOrderKey)
+	}
+
+	if got := strings.Join(headerLines(sendRecorded(t, nil, req)), ","); got != "X-C,X-B,X-A" {
+		t.Errorf("attached request wrote %s, want X-C,X-B,X-A", got)
+	}
+}
+
+// headerFields returns the lines of the wire format b that aren't written by
+// the transport, in order.
+func headerFields(b []byte) []string {
+	var fields []string
+	for _, line := range strings.Split(string(b), "\r\n")[1:] {
+		switch strings.ToLower(line[:strings.Index(line+":", ":")]) {
+		case "", "host", "user-agent", "accept-encoding", "connection":
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func TestOrderedHeaderWireCasing(t *testing.T) {
+	h := Apply()
+	defer h.Remove()
+
+	tests := []struct {
+		name   string
+		build  func(oh OrderedHeader)
+		fields string
+	}{
+		{
+			name: "add",
+			build: func(oh OrderedHeader) {
+				oh.Add("sec-ch-ua", "a")
+				oh.Add("X-MiXed", "b")
+			},
+			fields: "sec-ch-ua: a|X-MiXed: b",
+		},
+		{
+			name: "add again in another casing",
+			build: func(oh OrderedHeader) {
+				oh.Add("sec-ch-ua", "a")
+				oh.Add("Sec-Ch-Ua", "b")
+			},
+			fields: "sec-ch-ua: a|sec-ch-ua: b",
+		},
+		{
+			name: "set through http.Header",
+			build: func(oh OrderedHeader) {
+				oh.Add("sec-fetch-mode", "cors")
+				oh.Add("dnt", "0")
+				http.Header(oh).Set("sec-fetch-mode", "navigate")
+			},
+			fields: "sec-fetch-mode: navigate|dnt: 0",
+		},
+		{
+			name: "set recases",
+			build: func(oh OrderedHeader) {
+				oh.Add("sec-fetch-mode", "cors")
+				oh.Add("dnt", "0")
+				oh.Set("SEC-FETCH-MODE", "navigate")
+			},
+			fields: "SEC-FETCH-MODE: navigate|dnt: 0",
+		},
+		{
+			name: "del",
+			build: func(oh OrderedHeader) {
+				oh.Add("sec-ch-ua", "a")
+				oh.Add("dnt", "0")
+				oh.Del("Sec-Ch-Ua")
+			},
+			fields: "dnt: 0",
+		},
+	}
+
+	for _, test := range tests {
+		oh := make(OrderedHeader)
+		test.build(oh)
+
+		for _, rt := range []struct {
+			name string
+			rt   http.RoundTripper
+		}{
+			{"net/http", nil},
+			{"H1Transport", &H1Transport{}},
+		} {
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			req = oh.Attach(req)
+			head := sendRecorded(t, rt.rt, req)
+			if got := strings.Join(headerFields(head), "|"); got != test.fields {
+				t.Errorf("%s, %s: sent %s, want %s", test.name, rt.name, got, test.fields)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package httpmod
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	_ "unsafe"
+
+	"golang.org/x/net/http2"
+)
+
+// PriorityFrame is a PRIORITY frame sent right after the connection preface.
+type PriorityFrame struct {
+	StreamID uint32
+	http2.PriorityParam
+}
+
+type headersPriorityKey struct{}
+
+// WithHeadersPriority returns a copy of ctx that makes the request it is
+// attached to send priority on its HEADERS frame, overriding
+// H2Settings.HeadersPriority. A zero param sends no priority at all.
+func WithHeadersPriority(ctx context.Context, param http2.PriorityParam) context.Context {
+	return context.WithValue(ctx, headersPriorityKey{}, param)
+}
+
+// headersPriority returns the priority to send on the HEADERS frame of req.
+func headersPriority(req *http.Request, settings *H2Settings) http2.PriorityParam {
+	if param, ok := req.Context().Value(headersPriorityKey{}).(http2.PriorityParam); ok {
+		return param
+	}
+	if settings.HeadersPriority != nil {
+		return *settings.HeadersPriority
+	}
+	return http2.PriorityParam{}
+}
+
+type pendingPriority struct {
+	streamID uint32
+	param    http2.PriorityParam
+}
+
+// The stdlib encodes the request headers and writes them in separate calls,
+// the second of which doesn't know about the request anymore. Both happen
+// while cc.mu is held, so the priority of the next stream is parked here in
+// between.
+var pendingPriorities = struct {
+	sync.Mutex
+	m map[*ClientConn]pendingPriority
+}{m: make(map[*ClientConn]pendingPriority)}
+
+// setPendingPriority records the priority for the stream cc opens next.
+// cc.mu must be held.
+func setPendingPriority(cc *ClientConn, param http2.PriorityParam) {
+	pendingPriorities.Lock()
+	defer pendingPriorities.Unlock()
+
+	if param.IsZero() {
+		delete(pendingPriorities.m, cc)
+		return
+	}
+	pendingPriorities.m[cc] = pendingPriority{streamID: cc.nextStreamID, param: param}
+}
+
+// takePendingPriority returns the priority recorded for streamID, if any.
+func takePendingPriority(cc *ClientConn, streamID uint32) http2.PriorityParam {
+	pendingPriorities.Lock()
+	defer pendingPriorities.Unlock()
+
+	pending, ok := pendingPriorities.m[cc]
+	if !ok || pending.streamID != streamID {
+		return http2.PriorityParam{}
+	}
+	delete(pendingPriorities.m, cc)
+	return pending.param
+}
+
+//go:linkname stdlibWriteHeaders golang.org/x/net/http2.(*ClientConn).writeHeaders
+func stdlibWriteHeaders(cc *ClientConn, streamID uint32, endStream bool, maxFrameSize int, hdrs []byte) error
+
+// mostly YOINKED from http2. Only adding the priority to the HEADERS frame,
+// connections of transports that weren't configured have none pending
+func patchedWriteHeaders(cc *ClientConn, streamID uint32, endStream bool, maxFrameSize int, hdrs []byte) error {
+	priority := takePendingPriority(cc, streamID)
+
+	writeHeaderBlock(cc.fr, streamID, endStream, maxFrameSize, priority, hdrs)
+	cc.bw.Flush()
+	return cc.werr
+}
+
+// writeHeaderBlock writes hdrs as a HEADERS frame followed by as many
+// CONTINUATION frames as needed to stay within maxFrameSize.
+func writeHeaderBlock(fr *http2.Framer, streamID uint32, endStream bool, maxFrameSize int, priority http2.PriorityParam, hdrs []byte) {
+	first := true // first frame written (HEADERS is first, then CONTINUATION)
+	for len(hdrs) > 0 {
+		chunk := hdrs
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		hdrs = hdrs[len(chunk):]
+		endHeaders := len(hdrs) == 0
+		if first {
+			fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      streamID,
+				BlockFragment: chunk,
+				EndStream:     endStream,
+				EndHeaders:    endHeaders,
+				Priority:      priority,
+			})
+			first = false
+		} else {
+			fr.WriteContinuation(streamID, endHeaders, chunk)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package httpmod
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	utls "gitlab.com/yawning/utls.git"
+)
+
+// Profile bundles everything that makes up the fingerprint of a client: its
+// TLS ClientHello, its HTTP/2 connection preface and the headers it sends.
+type Profile struct {
+	Name string
+
+	// ClientHelloID picks one of the ClientHellos built in to uTLS. It is
+	// ignored if ClientHelloSpec is set.
+	ClientHelloID *utls.ClientHelloID
+
+	// ClientHelloSpec returns the ClientHello to send, for ClientHellos
+	// uTLS doesn't ship. It is called for every connection, because uTLS
+	// keeps state in the extensions of a spec.
+	ClientHelloSpec func() *utls.ClientHelloSpec
+
+	// H2Settings holds the SETTINGS, WINDOW_UPDATE and PRIORITY frames
+	// sent on HTTP/2 connections, and the pseudo header order.
+	H2Settings *H2Settings
+
+	// HeaderOrder is the order the headers of a request are written in,
+	// on HTTP/1.1 and, unless H2Settings.HeaderOrder is set, on HTTP/2.
+	HeaderOrder []string
+
+	// Headers are added to every request that doesn't set them itself. A
+	// key without values suppresses the header the transport would
+	// generate. When Accept-Encoding is added from here, responses in one
+	// of the ContentDecoders encodings are decoded.
+	Headers http.Header
+
+	// ContentDecoders decode response bodies by their Content-Encoding,
+	// on top of gzip and deflate. The standard library has no brotli
+	// decoder, so br bodies are handed out as the server encoded them
+	// unless one is added under "br".
+	ContentDecoders map[string]func(io.Reader) (io.Reader, error)
+}
+
+// defaultContentDecoders are the encodings decoded for every profile.
+var defaultContentDecoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	},
+}
+
+// contentDecoders returns the decoders of p merged with the default ones.
+func (p *Profile) contentDecoders() map[string]func(io.Reader) (io.Reader, error) {
+	decoders := make(map[string]func(io.Reader) (io.Reader, error), len(defaultContentDecoders)+len(p.ContentDecoders))
+	for encoding, decode := range defaultContentDecoders {
+		decoders[encoding] = decode
+	}
+	for encoding, decode := range p.ContentDecoders {
+		decoders[encoding] = decode
+	}
+	return decoders
+}
+
+// clone returns a copy of p that can be changed without affecting p.
+func (p *Profile) clone() *Profile {
+	clone := *p
+	if p.H2Settings != nil {
+		clone.H2Settings = p.H2Settings.clone()
+	}
+	if p.HeaderOrder != nil {
+		clone.HeaderOrder = append([]string(nil), p.HeaderOrder...)
+	}
+	clone.Headers = make(http.Header, len(p.Headers))
+	for key, values := range p.Headers {
+		clone.Headers[key] = append([]string(nil), values...)
+	}
+	if p.ContentDecoders != nil {
+		clone.ContentDecoders = make(map[string]func(io.Reader) (io.Reader, error), len(p.ContentDecoders))
+		for encoding, decode := range p.ContentDecoders {
+			clone.ContentDecoders[encoding] = decode
+		}
+	}
+	return &clone
+}
+
+// h2Settings returns the HTTP/2 settings of p with its header order filled
+// in.
+func (p *Profile) h2Settings() *H2Settings {
+	settings := DefaultH2Settings()
+	if p.H2Settings != nil {
+		settings = p.H2Settings.clone()
+	}
+	if settings.HeaderOrder == nil {
+		settings.HeaderOrder = p.HeaderOrder
+	}
+	return settings
+}
+
+var profileRegistry = struct {
+	sync.RWMutex
+	m map[string]*Profile
+}{m: make(map[string]*Profile)}
+
+// RegisterProfile makes p available under p.Name, replacing a profile that
+// was registered under the same name.
+func RegisterProfile(p *Profile) {
+	profileRegistry.Lock()
+	defer profileRegistry.Unlock()
+
+	profileRegistry.m[p.Name] = p.clone()
+}
+
+// ProfileByName returns a copy of the profile registered under name.
+func ProfileByName(name string) (*Profile, error) {
+	profileRegistry.RLock()
+	defer profileRegistry.RUnlock()
+
+	p, ok := profileRegistry.m[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	return p.clone(), nil
+}
+
+// ProfileNames returns the names of the registered profiles, sorted.
+func ProfileNames() []string {
+	profileRegistry.RLock()
+	defer profileRegistry.RUnlock()
+
+	names := make([]string, 0, len(profileRegistry.m))
+	for name := range profileRegistry.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FingerprintProfile returns a profile named name that sends the ClientHello
+// of the JA3 fingerprint ja3 and the HTTP/2 preface of the Akamai fingerprint
+// akamai, see ParseJA3 and ParseAkamai. It has no header order or default
+// headers.
+func FingerprintProfile(name, ja3, akamai string) (*Profile, error) {
+	if _, err := ParseJA3(ja3); err != nil {
+		return nil, err
+	}
+	settings, err := ParseAkamai(akamai)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Profile{
+		Name: name,
+		ClientHelloSpec: func() *utls.ClientHelloSpec {
+			spec, _ := ParseJA3(ja3)
+			return spec
+		},
+		H2Settings: settings,
+	}, nil
+}
+
+// NewClient returns an http.Client that presents profile. cfg and proxyURL
+// are used like in NewUTLSRoundTripper. Apply isn't needed, the client
+// writes the requests itself.
+func NewClient(profile *Profile, cfg *utls.Config, proxyURL *url.URL) (*http.Client, error) {
+	if profile.ClientHelloID == nil && profile.ClientHelloSpec == nil {
+		return nil, fmt.Errorf("profile %q has neither a ClientHelloID nor a ClientHelloSpec", profile.Name)
+	}
+
+	rt, err := newUTLSRoundTripper(profile.ClientHelloID, profile.ClientHelloSpec, cfg, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	rt.h2Settings = profile.h2Settings()
+	rt.h1HeaderOrder = profile.HeaderOrder
+
+	return &http.Client{
+		Transport: &profileRoundTripper{
+			rt:       rt,
+			headers:  profile.clone().Headers,
+			decoders: profile.contentDecoders(),
+		},
+	}, nil
+}
+
+// profileRoundTripper adds the default headers of a profile to requests,
+// and decodes the responses to the Accept-Encoding it added.
+type profileRoundTripper struct {
+	rt       http.RoundTripper
+	headers  http.Header
+	decoders map[string]func(io.Reader) (io.Reader, error)
+}
+
+func (rt *profileRoundTripper) CloseIdleConnections() {
+	closeIdleConnections(rt.rt)
+}
+
+func (rt *profileRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var missing []string
+	for key := range rt.headers {
+		if _, ok := lookupHeader(req.Header, key); !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return rt.rt.RoundTrip(req)
+	}
+
+	// a RoundTripper must not change the request it is given
+	req = req.Clone(req.Context())
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	addedEncoding := false
+	for _, key := range missing {
+		req.Header[key] = append([]string(nil), rt.headers[key]...)
+		if http.CanonicalHeaderKey(key) == "Accept-Encoding" && len(rt.headers[key]) > 0 {
+			addedEncoding = true
+		}
+	}
+
+	res, err := rt.rt.RoundTrip(req)
+	if err != nil || !addedEncoding {
+		return res, err
+	}
+	// like the transports do with the gzip they ask for themselves
+	if decode, ok := rt.decoders[res.Header.Get("Content-Encoding")]; ok {
+		res.Header.Del("Content-Encoding")
+		res.Header.Del("Content-Length")
+		res.ContentLength = -1
+		res.Uncompressed = true
+		res.Body = &decodingReader{body: res.Body, decode: decode}
+	}
+	return res, nil
+}
+
+// decodingReader decodes a response body, creating the decoder on the first
+// Read so bodies that are never read, like those of HEAD requests, aren't
+// touched.
+type decodingReader struct {
+	body   io.ReadCloser
+	decode func(io.Reader) (io.Reader, error)
+	r      io.Reader
+	err    error // sticky error
+}
+
+func (d *decodingReader) Read(p []byte) (n int, err error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.r == nil {
+		d.r, err = d.decode(d.body)
+		if err != nil {
+			d.err = err
+			return 0, err
+		}
+	}
+	return d.r.Read(p)
+}
+
+func (d *decodingReader) Close() error {
+	if c, ok := d.r.(io.Closer); ok {
+		c.Close()
+	}
+	return d.body.Close()
+}
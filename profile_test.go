@@ -0,0 +1,140 @@
+package httpmod
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestProfilesDecompress checks that the built-in profiles send the
+// Accept-Encoding of the browser and that the responses to it come back
+// decoded, except for br without a decoder.
+func TestProfilesDecompress(t *testing.T) {
+	var encoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), encoding) {
+			io.WriteString(w, "plain")
+			return
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		var zw io.WriteCloser
+		switch encoding {
+		case "gzip":
+			zw = gzip.NewWriter(w)
+		case "deflate":
+			zw = zlib.NewWriter(w)
+		case "br":
+			// a fake encoding, the test decoder strips the prefix
+			io.WriteString(w, "br:")
+			zw = nopWriteCloser{w}
+		}
+		io.WriteString(zw, "plain")
+		zw.Close()
+	}))
+	defer server.Close()
+
+	stripBr := func(r io.Reader) (io.Reader, error) {
+		prefix := make([]byte, len("br:"))
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	tests := []struct {
+		profile  string
+		encoding string
+		decoders map[string]func(io.Reader) (io.Reader, error)
+		accept   string
+		body     string
+	}{
+		{profile: "chrome_72", encoding: "gzip", accept: "gzip, deflate, br", body: "plain"},
+		{profile: "chrome_72", encoding: "deflate", accept: "gzip, deflate, br", body: "plain"},
+		{profile: "firefox_65", encoding: "gzip", accept: "gzip, deflate, br", body: "plain"},
+		{profile: "safari", encoding: "deflate", accept: "br, gzip, deflate", body: "plain"},
+		{profile: "chrome_72", encoding: "br", accept: "gzip, deflate, br", body: "br:plain"},
+		{
+			profile:  "ios",
+			encoding: "br",
+			decoders: map[string]func(io.Reader) (io.Reader, error){"br": stripBr},
+			accept:   "br, gzip, deflate",
+			body:     "plain",
+		},
+		// the transport asks for gzip itself and decodes it
+		{profile: "okhttp", encoding: "gzip", accept: "gzip", body: "plain"},
+		{profile: "curl", encoding: "gzip", accept: "", body: "plain"},
+	}
+
+	for _, test := range tests {
+		p, err := ProfileByName(test.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.ContentDecoders = test.decoders
+		rt := &profileRoundTripper{
+			rt:       &H1Transport{HeaderOrder: p.HeaderOrder},
+			headers:  p.clone().Headers,
+			decoders: p.contentDecoders(),
+		}
+
+		encoding = test.encoding
+		resp, err := rt.RoundTrip(mustRequest(t, "GET", server.URL, nil))
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.profile, test.encoding, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != test.body {
+			t.Errorf("%s %s: got body %q, %v, want %q", test.profile, test.encoding, body, err, test.body)
+		}
+		if got := resp.Header.Get("X-Accept-Encoding"); got != test.accept {
+			t.Errorf("%s %s: sent Accept-Encoding %q, want %q", test.profile, test.encoding, got, test.accept)
+		}
+	}
+}
+
+// TestProfileRoundTripperKeepsRequestEncoding checks that responses to an
+// Accept-Encoding set by the caller are handed out as they were encoded.
+func TestProfileRoundTripperKeepsRequestEncoding(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	io.WriteString(zw, "plain")
+	zw.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	p, _ := ProfileByName("chrome_72")
+	rt := &profileRoundTripper{
+		rt:       &H1Transport{HeaderOrder: p.HeaderOrder},
+		headers:  p.clone().Headers,
+		decoders: p.contentDecoders(),
+	}
+	req := mustRequest(t, "GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, compressed.Bytes()) || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("got body %q with Content-Encoding %q, want it as the server sent it", body, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
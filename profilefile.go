@@ -0,0 +1,809 @@
+package httpmod
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	utls "gitlab.com/yawning/utls.git"
+	"golang.org/x/net/http2"
+)
+
+// ProfileError is returned by LoadProfile for a profile that can't be used.
+// Field points at the offending value, e.g. "tls.extensions[3].curves[1]".
+type ProfileError struct {
+	Field string
+	Err   error
+}
+
+func (e *ProfileError) Error() string {
+	if e.Field == "" {
+		return e.Err.Error()
+	}
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *ProfileError) Unwrap() error {
+	return e.Err
+}
+
+func profileErrorf(field, format string, args ...interface{}) error {
+	return &ProfileError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// profileFile is the JSON representation of a Profile. Numbers that go on
+// the wire as 16 bits, like cipher suites, may be given as a number, as a
+// hex string like "0x1301", as "GREASE" or, where the field has them, by
+// name.
+//
+//	{
+//	  "name": "chrome_83",
+//	  "tls": {
+//	    "min_version": "1.0",
+//	    "max_version": "1.3",
+//	    "cipher_suites": ["GREASE", "0x1301", "0x1302", "0x1303", "0xc02b"],
+//	    "extensions": [
+//	      {"type": "grease"},
+//	      {"type": "server_name"},
+//	      {"type": "supported_groups", "curves": ["GREASE", "x25519", "secp256r1"]},
+//	      {"type": "alpn", "protocols": ["h2", "http/1.1"]},
+//	      {"type": "key_share", "curves": ["GREASE", "x25519"]},
+//	      {"type": "padding"}
+//	    ]
+//	  },
+//	  "http2": {
+//	    "settings": [{"id": 1, "value": 65536}, {"id": 3, "value": 1000}],
+//	    "window_update": 15663105,
+//	    "headers_priority": {"weight": 256, "exclusive": true},
+//	    "pseudo_header_order": [":method", ":authority", ":scheme", ":path"]
+//	  },
+//	  "header_order": ["Host", "User-Agent", "Accept", "*"],
+//	  "headers": {"User-Agent": "Mozilla/5.0 ...", "Accept-Encoding": null}
+//	}
+//
+// Instead of the ClientHello fields, "client_hello_id" may name one of the
+// uTLS presets, e.g. "hellochrome_72". A null header suppresses the header
+// the transport would generate.
+type profileFile struct {
+	Name        string             `json:"name"`
+	TLS         *tlsFile           `json:"tls"`
+	HTTP2       *http2File         `json:"http2"`
+	HeaderOrder []string           `json:"header_order"`
+	Headers     map[string]*string `json:"headers"`
+}
+
+type tlsFile struct {
+	ClientHelloID      string            `json:"client_hello_id"`
+	MinVersion         json.RawMessage   `json:"min_version"`
+	MaxVersion         json.RawMessage   `json:"max_version"`
+	CipherSuites       []json.RawMessage `json:"cipher_suites"`
+	CompressionMethods []uint8           `json:"compression_methods"`
+	Extensions         []extensionFile   `json:"extensions"`
+}
+
+type extensionFile struct {
+	Type string `json:"type"`
+
+	Curves        []json.RawMessage `json:"curves"`
+	PointFormats  []uint8           `json:"point_formats"`
+	Algorithms    []json.RawMessage `json:"algorithms"`
+	Protocols     []string          `json:"protocols"`
+	Versions      []json.RawMessage `json:"versions"`
+	Modes         []uint8           `json:"modes"`
+	Renegotiation string            `json:"renegotiation"`
+	Length        *int              `json:"length"`
+	Limit         uint16            `json:"limit"`
+}
+
+type http2File struct {
+	Settings              []settingFile           `json:"settings"`
+	WindowUpdate          uint32                  `json:"window_update"`
+	PriorityFrames        []priorityFile          `json:"priority_frames"`
+	HeadersPriority       *priorityFile           `json:"headers_priority"`
+	PseudoHeaderOrder     []string                `json:"pseudo_header_order"`
+	HeaderOrder           []string                `json:"header_order"`
+	CombineCookies        bool                    `json:"combine_cookies"`
+	CookiePlacement       string                  `json:"cookie_placement"`
+	HeaderEncodings       map[string]encodingFile `json:"header_encodings"`
+	DefaultHeaderEncoding *encodingFile           `json:"default_header_encoding"`
+	EncoderTableSize      uint32                  `json:"encoder_table_size"`
+	TableSizeUpdate       bool                    `json:"table_size_update"`
+}
+
+type settingFile struct {
+	ID    json.RawMessage `json:"id"`
+	Value *uint32         `json:"value"`
+}
+
+// priorityFile holds a priority the way it is usually written down, with
+// the weight from 1 to 256.
+type priorityFile struct {
+	StreamID  uint32 `json:"stream_id"`
+	DependsOn uint32 `json:"depends_on"`
+	Weight    int    `json:"weight"`
+	Exclusive bool   `json:"exclusive"`
+}
+
+type encodingFile struct {
+	Indexing string `json:"indexing"`
+	Huffman  string `json:"huffman"`
+}
+
+// LoadProfile reads a profile in the JSON format shown at profileFile.
+// Errors about the contents are of type *ProfileError.
+func LoadProfile(r io.Reader) (*Profile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var file profileFile
+	if err := dec.Decode(&file); err != nil {
+		return nil, jsonProfileError(data, err)
+	}
+	return file.profile()
+}
+
+// LoadProfileFile reads the profile stored in the file name.
+func LoadProfileFile(name string) (*Profile, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := LoadProfile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return p, nil
+}
+
+// jsonProfileError turns an error of encoding/json into a ProfileError.
+func jsonProfileError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, column := lineAndColumn(data, syntaxErr.Offset)
+		return profileErrorf("", "line %d, column %d: %v", line, column, syntaxErr)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return profileErrorf(jsonErrorField(data, typeErr.Field), "expected %s, got %s", typeErr.Type, typeErr.Value)
+	}
+	// encoding/json has no error type for these
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		return profileErrorf(jsonErrorField(data, ""), "unknown field")
+	}
+	return &ProfileError{Err: err}
+}
+
+// jsonErrorField returns the path of the value in data that doesn't fit
+// into a profileFile, in the form of ProfileError.Field. encoding/json
+// leaves the indexes of arrays out of its paths and the keys it doesn't know
+// out of its errors, so the document is walked again. fallback is returned
+// if the walk doesn't find the value.
+func jsonErrorField(data []byte, fallback string) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fallback
+	}
+	if field, ok := misfit(reflect.TypeOf(profileFile{}), v, ""); ok {
+		return field
+	}
+	return fallback
+}
+
+// misfit returns the path of the first value in v, the decoded JSON at
+// path, that can't be decoded into t.
+func misfit(t reflect.Type, v interface{}, path string) (string, bool) {
+	if v == nil || t == reflect.TypeOf(json.RawMessage(nil)) {
+		return "", false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return path, true
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := jsonField(t, key)
+			if !ok {
+				return joinField(path, key), true
+			}
+			if misfitField, ok := misfit(field.Type, obj[key], joinField(path, key)); ok {
+				return misfitField, true
+			}
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return path, true
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if field, ok := misfit(t.Elem(), obj[key], fmt.Sprintf("%s[%q]", path, key)); ok {
+				return field, true
+			}
+		}
+	case reflect.Slice:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return path, true
+		}
+		for i, elem := range arr {
+			if field, ok := misfit(t.Elem(), elem, fmt.Sprintf("%s[%d]", path, i)); ok {
+				return field, true
+			}
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			return path, true
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return path, true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) || reflect.Zero(t).OverflowInt(int64(n)) {
+			return path, true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) || n < 0 || reflect.Zero(t).OverflowUint(uint64(n)) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// jsonField finds the field of t that encoding/json decodes key into.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinField(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func lineAndColumn(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+func (f *profileFile) profile() (*Profile, error) {
+	if f.Name == "" {
+		return nil, profileErrorf("name", "missing")
+	}
+	p := &Profile{Name: f.Name}
+
+	if f.TLS == nil {
+		return nil, profileErrorf("tls", "missing")
+	}
+	if f.TLS.ClientHelloID != "" {
+		if f.TLS.hasSpec() {
+			return nil, profileErrorf("tls.client_hello_id", "can't be combined with a ClientHello spec")
+		}
+		id, err := ClientHelloIDByName(f.TLS.ClientHelloID)
+		if err != nil {
+			return nil, &ProfileError{Field: "tls.client_hello_id", Err: err}
+		}
+		if id == nil {
+			return nil, profileErrorf("tls.client_hello_id", "%q doesn't use uTLS", f.TLS.ClientHelloID)
+		}
+		p.ClientHelloID = id
+	} else {
+		// check the spec once, later calls can't fail
+		if _, err := f.TLS.spec(); err != nil {
+			return nil, err
+		}
+		spec := f.TLS
+		p.ClientHelloSpec = func() *utls.ClientHelloSpec {
+			s, _ := spec.spec()
+			return s
+		}
+	}
+
+	if f.HTTP2 != nil {
+		settings, err := f.HTTP2.settings()
+		if err != nil {
+			return nil, err
+		}
+		p.H2Settings = settings
+	}
+
+	if err := checkHeaderOrder("header_order", f.HeaderOrder); err != nil {
+		return nil, err
+	}
+	p.HeaderOrder = f.HeaderOrder
+
+	p.Headers = make(http.Header, len(f.Headers))
+	for name, value := range f.Headers {
+		if name == "" {
+			return nil, profileErrorf("headers", "empty header name")
+		}
+		key := http.CanonicalHeaderKey(name)
+		if value == nil {
+			p.Headers[key] = nil
+			continue
+		}
+		p.Headers[key] = []string{*value}
+	}
+	return p, nil
+}
+
+func (t *tlsFile) hasSpec() bool {
+	return t.MinVersion != nil || t.MaxVersion != nil || t.CipherSuites != nil ||
+		t.CompressionMethods != nil || t.Extensions != nil
+}
+
+// spec builds a new ClientHelloSpec from t.
+func (t *tlsFile) spec() (*utls.ClientHelloSpec, error) {
+	spec := &utls.ClientHelloSpec{
+		TLSVersMin:         0x0301,
+		TLSVersMax:         0x0304,
+		CompressionMethods: t.CompressionMethods,
+	}
+	if spec.CompressionMethods == nil {
+		spec.CompressionMethods = []uint8{0}
+	}
+
+	var err error
+	if t.MinVersion != nil {
+		if spec.TLSVersMin, err = parseUint16("tls.min_version", t.MinVersion, tlsVersionNames); err != nil {
+			return nil, err
+		}
+	}
+	if t.MaxVersion != nil {
+		if spec.TLSVersMax, err = parseUint16("tls.max_version", t.MaxVersion, tlsVersionNames); err != nil {
+			return nil, err
+		}
+	}
+	if spec.TLSVersMin > spec.TLSVersMax {
+		return nil, profileErrorf("tls.min_version", "above max_version")
+	}
+
+	if len(t.CipherSuites) == 0 {
+		return nil, profileErrorf("tls.cipher_suites", "missing")
+	}
+	if spec.CipherSuites, err = parseUint16s("tls.cipher_suites", t.CipherSuites, nil); err != nil {
+		return nil, err
+	}
+
+	if len(t.Extensions) == 0 {
+		return nil, profileErrorf("tls.extensions", "missing")
+	}
+	seen := make(map[string]bool)
+	for i, e := range t.Extensions {
+		field := fmt.Sprintf("tls.extensions[%d]", i)
+		// only GREASE extensions may repeat
+		if seen[e.Type] && e.Type != "grease" {
+			return nil, profileErrorf(field+".type", "duplicate extension %q", e.Type)
+		}
+		seen[e.Type] = true
+
+		ext, err := e.extension(field)
+		if err != nil {
+			return nil, err
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+	return spec, nil
+}
+
+func (e *extensionFile) extension(field string) (utls.TLSExtension, error) {
+	switch e.Type {
+	case "server_name":
+		return &utls.SNIExtension{}, nil
+	case "status_request":
+		return &utls.StatusRequestExtension{}, nil
+	case "supported_groups":
+		curves, err := e.curves(field)
+		if err != nil {
+			return nil, err
+		}
+		return &utls.SupportedCurvesExtension{Curves: curves}, nil
+	case "ec_point_formats":
+		if len(e.PointFormats) == 0 {
+			return nil, profileErrorf(field+".point_formats", "missing")
+		}
+		return &utls.SupportedPointsExtension{SupportedPoints: e.PointFormats}, nil
+	case "signature_algorithms":
+		if len(e.Algorithms) == 0 {
+			return nil, profileErrorf(field+".algorithms", "missing")
+		}
+		values, err := parseUint16s(field+".algorithms", e.Algorithms, signatureSchemeNames)
+		if err != nil {
+			return nil, err
+		}
+		algorithms := make([]utls.SignatureScheme, len(values))
+		for i, v := range values {
+			algorithms[i] = utls.SignatureScheme(v)
+		}
+		return &utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: algorithms}, nil
+	case "alpn":
+		if len(e.Protocols) == 0 {
+			return nil, profileErrorf(field+".protocols", "missing")
+		}
+		for i, protocol := range e.Protocols {
+			if protocol == "" || len(protocol) > 255 {
+				return nil, profileErrorf(fmt.Sprintf("%s.protocols[%d]", field, i), "invalid protocol %q", protocol)
+			}
+		}
+		return &utls.ALPNExtension{AlpnProtocols: e.Protocols}, nil
+	case "signed_certificate_timestamp":
+		return &utls.SCTExtension{}, nil
+	case "padding":
+		if e.Length == nil {
+			return &utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle}, nil
+		}
+		if *e.Length < 0 || *e.Length > math.MaxUint16 {
+			return nil, profileErrorf(field+".length", "out of range")
+		}
+		return &utls.UtlsPaddingExtension{PaddingLen: *e.Length, WillPad: true}, nil
+	case "extended_master_secret":
+		return &utls.UtlsExtendedMasterSecretExtension{}, nil
+	case "compress_certificate":
+		if len(e.Algorithms) == 0 {
+			return nil, profileErrorf(field+".algorithms", "missing")
+		}
+		values, err := parseUint16s(field+".algorithms", e.Algorithms, certCompressionNames)
+		if err != nil {
+			return nil, err
+		}
+		algorithms := make([]utls.CertCompressionAlgo, len(values))
+		for i, v := range values {
+			algorithms[i] = utls.CertCompressionAlgo(v)
+		}
+		return &utls.CompressCertificateExtension{Algorithms: algorithms}, nil
+	case "record_size_limit":
+		if e.Limit < 64 {
+			return nil, profileErrorf(field+".limit", "must be at least 64")
+		}
+		return &utls.FakeRecordSizeLimitExtension{Limit: e.Limit}, nil
+	case "session_ticket":
+		return &utls.SessionTicketExtension{}, nil
+	case "supported_versions":
+		if len(e.Versions) == 0 {
+			return nil, profileErrorf(field+".versions", "missing")
+		}
+		versions, err := parseUint16s(field+".versions", e.Versions, tlsVersionNames)
+		if err != nil {
+			return nil, err
+		}
+		return &utls.SupportedVersionsExtension{Versions: versions}, nil
+	case "psk_key_exchange_modes":
+		if len(e.Modes) == 0 {
+			return nil, profileErrorf(field+".modes", "missing")
+		}
+		return &utls.PSKKeyExchangeModesExtension{Modes: e.Modes}, nil
+	case "key_share":
+		curves, err := e.curves(field)
+		if err != nil {
+			return nil, err
+		}
+		shares := make([]utls.KeyShare, len(curves))
+		for i, curve := range curves {
+			shares[i] = utls.KeyShare{Group: curve}
+			if curve == utls.CurveID(utls.GREASE_PLACEHOLDER) {
+				// like the uTLS Chrome presets
+				shares[i].Data = []byte{0}
+			}
+		}
+		return &utls.KeyShareExtension{KeyShares: shares}, nil
+	case "channel_id":
+		return &utls.FakeChannelIDExtension{}, nil
+	case "renegotiation_info":
+		// uTLS can only send the extension the way its presets do
+		if e.Renegotiation != "" && e.Renegotiation != "once" {
+			return nil, profileErrorf(field+".renegotiation", "unsupported value %q, only \"once\" is", e.Renegotiation)
+		}
+		return renegotiationInfoExtension(), nil
+	case "grease":
+		return &utls.UtlsGREASEExtension{}, nil
+	case "":
+		return nil, profileErrorf(field+".type", "missing")
+	default:
+		return nil, profileErrorf(field+".type", "unknown extension %q", e.Type)
+	}
+}
+
+func (e *extensionFile) curves(field string) ([]utls.CurveID, error) {
+	if len(e.Curves) == 0 {
+		return nil, profileErrorf(field+".curves", "missing")
+	}
+	values, err := parseUint16s(field+".curves", e.Curves, curveNames)
+	if err != nil {
+		return nil, err
+	}
+	curves := make([]utls.CurveID, len(values))
+	for i, v := range values {
+		curves[i] = utls.CurveID(v)
+	}
+	return curves, nil
+}
+
+var tlsVersionNames = map[string]uint16{
+	"1.0": 0x0301,
+	"1.1": 0x0302,
+	"1.2": 0x0303,
+	"1.3": 0x0304,
+}
+
+var curveNames = map[string]uint16{
+	"secp256r1": uint16(utls.CurveP256),
+	"secp384r1": uint16(utls.CurveP384),
+	"secp521r1": uint16(utls.CurveP521),
+	"x25519":    uint16(utls.X25519),
+	"x448":      30,
+}
+
+var signatureSchemeNames = map[string]uint16{
+	"rsa_pkcs1_sha1":         0x0201,
+	"ecdsa_sha1":             0x0203,
+	"rsa_pkcs1_sha256":       0x0401,
+	"ecdsa_secp256r1_sha256": 0x0403,
+	"rsa_pkcs1_sha384":       0x0501,
+	"ecdsa_secp384r1_sha384": 0x0503,
+	"rsa_pkcs1_sha512":       0x0601,
+	"ecdsa_secp521r1_sha512": 0x0603,
+	"rsa_pss_rsae_sha256":    0x0804,
+	"rsa_pss_rsae_sha384":    0x0805,
+	"rsa_pss_rsae_sha512":    0x0806,
+	"ed25519":                0x0807,
+	"ed448":                  0x0808,
+	"rsa_pss_pss_sha256":     0x0809,
+	"rsa_pss_pss_sha384":     0x080a,
+	"rsa_pss_pss_sha512":     0x080b,
+}
+
+var certCompressionNames = map[string]uint16{
+	"zlib":   1,
+	"brotli": 2,
+	"zstd":   3,
+}
+
+// parseUint16 parses a 16 bit wire value given as a number, a hex string,
+// "GREASE" or one of names.
+func parseUint16(field string, raw json.RawMessage, names map[string]uint16) (uint16, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(raw, &n); err != nil || n < 0 || n > math.MaxUint16 {
+			return 0, profileErrorf(field, "expected a 16 bit number or a name, got %s", raw)
+		}
+		return uint16(n), nil
+	}
+
+	if s == "GREASE" {
+		return utls.GREASE_PLACEHOLDER, nil
+	}
+	if v, ok := names[s]; ok {
+		return v, nil
+	}
+	if strings.HasPrefix(s, "0x") {
+		if v, err := strconv.ParseUint(s[2:], 16, 16); err == nil {
+			return uint16(v), nil
+		}
+	}
+	return 0, profileErrorf(field, "unknown value %q", s)
+}
+
+func parseUint16s(field string, raws []json.RawMessage, names map[string]uint16) ([]uint16, error) {
+	values := make([]uint16, len(raws))
+	for i, raw := range raws {
+		v, err := parseUint16(fmt.Sprintf("%s[%d]", field, i), raw, names)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+var settingNames = map[string]uint16{
+	"HEADER_TABLE_SIZE":      uint16(http2.SettingHeaderTableSize),
+	"ENABLE_PUSH":            uint16(http2.SettingEnablePush),
+	"MAX_CONCURRENT_STREAMS": uint16(http2.SettingMaxConcurrentStreams),
+	"INITIAL_WINDOW_SIZE":    uint16(http2.SettingInitialWindowSize),
+	"MAX_FRAME_SIZE":         uint16(http2.SettingMaxFrameSize),
+	"MAX_HEADER_LIST_SIZE":   uint16(http2.SettingMaxHeaderListSize),
+}
+
+func (f *http2File) settings() (*H2Settings, error) {
+	settings := &H2Settings{
+		ConnFlow:             f.WindowUpdate,
+		InitialWindowSize:    65535,
+		MaxConcurrentStreams: 1000,
+		Settings:             []http2.Setting{},
+		CombineCookies:       f.CombineCookies,
+		EncoderTableSize:     f.EncoderTableSize,
+		TableSizeUpdate:      f.TableSizeUpdate,
+	}
+
+	for i, s := range f.Settings {
+		field := fmt.Sprintf("http2.settings[%d]", i)
+		if s.ID == nil {
+			return nil, profileErrorf(field+".id", "missing")
+		}
+		id, err := parseUint16(field+".id", s.ID, settingNames)
+		if err != nil {
+			return nil, err
+		}
+		if s.Value == nil {
+			return nil, profileErrorf(field+".value", "missing")
+		}
+		setting := http2.Setting{ID: http2.SettingID(id), Val: *s.Value}
+		if err := setting.Valid(); err != nil {
+			return nil, profileErrorf(field+".value", "%v", err)
+		}
+		settings.Settings = append(settings.Settings, setting)
+	}
+	settings.MaxConcurrentStreams = settings.settingValue(http2.SettingMaxConcurrentStreams, 1000)
+
+	if f.WindowUpdate > math.MaxInt32-settings.InitialWindowSize {
+		return nil, profileErrorf("http2.window_update", "window would exceed 2^31-1")
+	}
+
+	for i, frame := range f.PriorityFrames {
+		field := fmt.Sprintf("http2.priority_frames[%d]", i)
+		param, err := frame.param(field)
+		if err != nil {
+			return nil, err
+		}
+		if frame.StreamID == 0 {
+			return nil, profileErrorf(field+".stream_id", "must not be 0")
+		}
+		if frame.StreamID == frame.DependsOn {
+			return nil, profileErrorf(field+".depends_on", "stream can't depend on itself")
+		}
+		settings.PriorityFrames = append(settings.PriorityFrames, PriorityFrame{StreamID: frame.StreamID, PriorityParam: param})
+	}
+	if f.HeadersPriority != nil {
+		param, err := f.HeadersPriority.param("http2.headers_priority")
+		if err != nil {
+			return nil, err
+		}
+		settings.HeadersPriority = &param
+	}
+
+	seen := make(map[string]bool)
+	for i, name := range f.PseudoHeaderOrder {
+		field := fmt.Sprintf("http2.pseudo_header_order[%d]", i)
+		switch name {
+		case ":authority", ":method", ":path", ":scheme":
+		default:
+			return nil, profileErrorf(field, "unknown pseudo header %q", name)
+		}
+		if seen[name] {
+			return nil, profileErrorf(field, "duplicate pseudo header %q", name)
+		}
+		seen[name] = true
+	}
+	settings.PseudoHeaderOrder = f.PseudoHeaderOrder
+
+	if err := checkHeaderOrder("http2.header_order", f.HeaderOrder); err != nil {
+		return nil, err
+	}
+	settings.HeaderOrder = f.HeaderOrder
+
+	switch f.CookiePlacement {
+	case "", "in_order":
+		settings.CookiePlacement = CookiesInOrder
+	case "first":
+		settings.CookiePlacement = CookiesFirst
+	case "last":
+		settings.CookiePlacement = CookiesLast
+	default:
+		return nil, profileErrorf("http2.cookie_placement", "unknown value %q", f.CookiePlacement)
+	}
+
+	if f.HeaderEncodings != nil {
+		settings.HeaderEncodings = make(map[string]HeaderEncoding, len(f.HeaderEncodings))
+		for name, encoding := range f.HeaderEncodings {
+			e, err := encoding.encoding(fmt.Sprintf("http2.header_encodings[%q]", name))
+			if err != nil {
+				return nil, err
+			}
+			settings.HeaderEncodings[strings.ToLower(name)] = e
+		}
+	}
+	if f.DefaultHeaderEncoding != nil {
+		e, err := f.DefaultHeaderEncoding.encoding("http2.default_header_encoding")
+		if err != nil {
+			return nil, err
+		}
+		settings.DefaultHeaderEncoding = e
+	}
+
+	return settings, nil
+}
+
+func (p *priorityFile) param(field string) (http2.PriorityParam, error) {
+	if p.Weight < 1 || p.Weight > 256 {
+		return http2.PriorityParam{}, profileErrorf(field+".weight", "must be between 1 and 256")
+	}
+	return http2.PriorityParam{
+		StreamDep: p.DependsOn,
+		Exclusive: p.Exclusive,
+		Weight:    uint8(p.Weight - 1),
+	}, nil
+}
+
+func (e *encodingFile) encoding(field string) (HeaderEncoding, error) {
+	var encoding HeaderEncoding
+	switch e.Indexing {
+	case "", "incremental":
+		encoding.Indexing = IndexIncremental
+	case "without":
+		encoding.Indexing = IndexWithout
+	case "never":
+		encoding.Indexing = IndexNever
+	default:
+		return encoding, profileErrorf(field+".indexing", "unknown value %q", e.Indexing)
+	}
+	switch e.Huffman {
+	case "", "shortest":
+		encoding.Huffman = HuffmanShortest
+	case "always":
+		encoding.Huffman = HuffmanAlways
+	case "never":
+		encoding.Huffman = HuffmanNever
+	default:
+		return encoding, profileErrorf(field+".huffman", "unknown value %q", e.Huffman)
+	}
+	return encoding, nil
+}
+
+// checkHeaderOrder rejects empty and repeated names in a header order.
+func checkHeaderOrder(field string, order []string) error {
+	seen := make(map[string]bool)
+	for i, name := range order {
+		lowKey := strings.ToLower(name)
+		if name == "" {
+			return profileErrorf(fmt.Sprintf("%s[%d]", field, i), "empty header name")
+		}
+		if seen[lowKey] {
+			return profileErrorf(fmt.Sprintf("%s[%d]", field, i), "duplicate header %q", name)
+		}
+		seen[lowKey] = true
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package httpmod
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// profileJSON returns a profile file with tls and http2 as the values of
+// the keys of the same name.
+func profileJSON(tls, http2 string) string {
+	return `{"name": "test", "tls": ` + tls + `, "http2": ` + http2 + `}`
+}
+
+const validTLS = `{"cipher_suites": ["0x1301"], "extensions": [{"type": "server_name"}]}`
+
+func TestLoadProfileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		field string
+	}{
+		{"syntax", `{"name": "test",`, ""},
+		{"no name", `{"tls": ` + validTLS + `}`, "name"},
+		{"no tls", `{"name": "test"}`, "tls"},
+		{"unknown key", `{"name": "test", "tls": ` + validTLS + `, "colour": 1}`, "colour"},
+		{"unknown nested key", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "server_name"}, {"type": "alpn", "protocol": ["h2"]}]}`, `{}`), "tls.extensions[1].protocol"},
+		{"name type", `{"name": 1, "tls": ` + validTLS + `}`, "name"},
+		{"compression method type", profileJSON(`{"cipher_suites": ["0x1301"], "compression_methods": [0, "one"], "extensions": [{"type": "server_name"}]}`, `{}`), "tls.compression_methods[1]"},
+		{"compression method range", profileJSON(`{"cipher_suites": ["0x1301"], "compression_methods": [256], "extensions": [{"type": "server_name"}]}`, `{}`), "tls.compression_methods[0]"},
+		{"settings type", profileJSON(validTLS, `{"settings": {"id": 1}}`), "http2.settings"},
+		{"header value type", `{"name": "test", "tls": ` + validTLS + `, "headers": {"Accept": ["*/*"]}}`, `headers["Accept"]`},
+		{"unknown client hello id", profileJSON(`{"client_hello_id": "hellonetscape_4"}`, `{}`), "tls.client_hello_id"},
+		{"client hello id with spec", profileJSON(`{"client_hello_id": "hellofirefox_65", "cipher_suites": ["0x1301"]}`, `{}`), "tls.client_hello_id"},
+		{"versions swapped", profileJSON(`{"min_version": "1.3", "max_version": "1.2", "cipher_suites": ["0x1301"], "extensions": [{"type": "server_name"}]}`, `{}`), "tls.min_version"},
+		{"unknown version", profileJSON(`{"min_version": "1.4", "cipher_suites": ["0x1301"], "extensions": [{"type": "server_name"}]}`, `{}`), "tls.min_version"},
+		{"no cipher suites", profileJSON(`{"extensions": [{"type": "server_name"}]}`, `{}`), "tls.cipher_suites"},
+		{"bad cipher name", profileJSON(`{"cipher_suites": ["0x1301", "TLS_AES_128_GCM_SHA256"], "extensions": [{"type": "server_name"}]}`, `{}`), "tls.cipher_suites[1]"},
+		{"bad cipher hex", profileJSON(`{"cipher_suites": ["0x13011"], "extensions": [{"type": "server_name"}]}`, `{}`), "tls.cipher_suites[0]"},
+		{"cipher out of range", profileJSON(`{"cipher_suites": [65536], "extensions": [{"type": "server_name"}]}`, `{}`), "tls.cipher_suites[0]"},
+		{"no extensions", profileJSON(`{"cipher_suites": ["0x1301"]}`, `{}`), "tls.extensions"},
+		{"unknown extension", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "server_name"}, {"type": "early_data"}]}`, `{}`), "tls.extensions[1].type"},
+		{"extension without type", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{}]}`, `{}`), "tls.extensions[0].type"},
+		{"duplicate extension", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "server_name"}, {"type": "server_name"}]}`, `{}`), "tls.extensions[1].type"},
+		{"bad curve name", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "supported_groups", "curves": ["x25519", "p256"]}]}`, `{}`), "tls.extensions[0].curves[1]"},
+		{"no key share curves", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "server_name"}, {"type": "key_share"}]}`, `{}`), "tls.extensions[1].curves"},
+		{"bad signature algorithm", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "signature_algorithms", "algorithms": ["ed25519", "rsa"]}]}`, `{}`), "tls.extensions[0].algorithms[1]"},
+		{"empty alpn protocol", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "alpn", "protocols": ["h2", ""]}]}`, `{}`), "tls.extensions[0].protocols[1]"},
+		{"padding out of range", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "padding", "length": 65536}]}`, `{}`), "tls.extensions[0].length"},
+		{"record size limit", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "record_size_limit", "limit": 63}]}`, `{}`), "tls.extensions[0].limit"},
+		{"renegotiation", profileJSON(`{"cipher_suites": ["0x1301"], "extensions": [{"type": "renegotiation_info", "renegotiation": "freely"}]}`, `{}`), "tls.extensions[0].renegotiation"},
+		{"setting without id", profileJSON(validTLS, `{"settings": [{"value": 1}]}`), "http2.settings[0].id"},
+		{"unknown setting name", profileJSON(validTLS, `{"settings": [{"id": "ENABLE_CONNECT_PROTOCOL", "value": 1}]}`), "http2.settings[0].id"},
+		{"setting without value", profileJSON(validTLS, `{"settings": [{"id": 1}]}`), "http2.settings[0].value"},
+		{"enable push out of range", profileJSON(validTLS, `{"settings": [{"id": 1, "value": 4096}, {"id": "ENABLE_PUSH", "value": 2}]}`), "http2.settings[1].value"},
+		{"initial window out of range", profileJSON(validTLS, `{"settings": [{"id": "INITIAL_WINDOW_SIZE", "value": 2147483648}]}`), "http2.settings[0].value"},
+		{"max frame size out of range", profileJSON(validTLS, `{"settings": [{"id": "MAX_FRAME_SIZE", "value": 16383}]}`), "http2.settings[0].value"},
+		{"setting value type", profileJSON(validTLS, `{"settings": [{"id": 1, "value": -1}]}`), "http2.settings[0].value"},
+		{"window update out of range", profileJSON(validTLS, `{"window_update": 2147483647}`), "http2.window_update"},
+		{"priority weight", profileJSON(validTLS, `{"priority_frames": [{"stream_id": 3, "weight": 0}]}`), "http2.priority_frames[0].weight"},
+		{"priority on stream 0", profileJSON(validTLS, `{"priority_frames": [{"weight": 1}]}`), "http2.priority_frames[0].stream_id"},
+		{"priority on itself", profileJSON(validTLS, `{"priority_frames": [{"stream_id": 3, "depends_on": 3, "weight": 1}]}`), "http2.priority_frames[0].depends_on"},
+		{"headers priority weight", profileJSON(validTLS, `{"headers_priority": {"weight": 257}}`), "http2.headers_priority.weight"},
+		{"unknown pseudo header", profileJSON(validTLS, `{"pseudo_header_order": [":method", ":protocol"]}`), "http2.pseudo_header_order[1]"},
+		{"duplicate pseudo header", profileJSON(validTLS, `{"pseudo_header_order": [":method", ":method"]}`), "http2.pseudo_header_order[1]"},
+		{"cookie placement", profileJSON(validTLS, `{"cookie_placement": "middle"}`), "http2.cookie_placement"},
+		{"header indexing", profileJSON(validTLS, `{"header_encodings": {"Cookie": {"indexing": "sometimes"}}}`), `http2.header_encodings["Cookie"].indexing`},
+		{"default huffman", profileJSON(validTLS, `{"default_header_encoding": {"huffman": "sometimes"}}`), "http2.default_header_encoding.huffman"},
+		{"duplicate header", `{"name": "test", "tls": ` + validTLS + `, "header_order": ["Host", "Accept", "accept"]}`, "header_order[2]"},
+		{"empty header in order", profileJSON(validTLS, `{"header_order": ["Host", ""]}`), "http2.header_order[1]"},
+		{"empty header name", `{"name": "test", "tls": ` + validTLS + `, "headers": {"": "x"}}`, "headers"},
+	}
+
+	for _, test := range tests {
+		_, err := LoadProfile(strings.NewReader(test.json))
+		var profileErr *ProfileError
+		if !errors.As(err, &profileErr) {
+			t.Errorf("%s: got error %v, want a *ProfileError", test.name, err)
+			continue
+		}
+		if profileErr.Field != test.field {
+			t.Errorf("%s: got error %q at %q, want it at %q", test.name, err, profileErr.Field, test.field)
+		}
+	}
+}
+
+// TestLoadProfileFile checks that the profile file of a built-in profile
+// loads into the same profile.
+func TestLoadProfileFile(t *testing.T) {
+	loaded, err := LoadProfileFile("testdata/firefox_65.profile.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builtin, _ := ProfileByName("firefox_65")
+
+	if loaded.Name != builtin.Name {
+		t.Errorf("Name = %q, want %q", loaded.Name, builtin.Name)
+	}
+	if loaded.ClientHelloID != builtin.ClientHelloID {
+		t.Errorf("ClientHelloID = %v, want %v", loaded.ClientHelloID, builtin.ClientHelloID)
+	}
+	if !reflect.DeepEqual(loaded.H2Settings, builtin.H2Settings) {
+		t.Errorf("H2Settings = %+v, want %+v", loaded.H2Settings, builtin.H2Settings)
+	}
+	if !reflect.DeepEqual(loaded.HeaderOrder, builtin.HeaderOrder) {
+		t.Errorf("HeaderOrder = %q, want %q", loaded.HeaderOrder, builtin.HeaderOrder)
+	}
+	if !reflect.DeepEqual(loaded.Headers, builtin.Headers) {
+		t.Errorf("Headers = %q, want %q", loaded.Headers, builtin.Headers)
+	}
+
+	if _, err := LoadProfileFile("testdata/missing.profile.json"); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+}
@@ -0,0 +1,290 @@
+package httpmod
+
+import (
+	"net/http"
+
+	utls "gitlab.com/yawning/utls.git"
+	"golang.org/x/net/http2"
+)
+
+// The built-in profiles. The HTTP/2 values are the Akamai fingerprints of
+// the clients, the headers those of a top level navigation.
+func init() {
+	for _, chrome := range []struct {
+		name, version     string
+		id                *utls.ClientHelloID
+		maxHeaderListSize uint32
+	}{
+		{"chrome_58", "58.0.3029.110", &utls.HelloChrome_58, 0},
+		{"chrome_62", "62.0.3202.94", &utls.HelloChrome_62, 0},
+		{"chrome_70", "70.0.3538.110", &utls.HelloChrome_70, 262144},
+		{"chrome_72", "72.0.3626.121", &utls.HelloChrome_72, 262144},
+	} {
+		RegisterProfile(chromeProfile(chrome.name, chrome.version, chrome.id, chrome.maxHeaderListSize))
+	}
+
+	for _, firefox := range []struct {
+		name, version string
+		id            *utls.ClientHelloID
+	}{
+		{"firefox_55", "55.0", &utls.HelloFirefox_55},
+		{"firefox_56", "56.0", &utls.HelloFirefox_56},
+		{"firefox_63", "63.0", &utls.HelloFirefox_63},
+		{"firefox_65", "65.0", &utls.HelloFirefox_65},
+	} {
+		RegisterProfile(firefoxProfile(firefox.name, firefox.version, firefox.id))
+	}
+
+	// uTLS has no macOS preset, Safari uses the same TLS stack as iOS
+	RegisterProfile(appleProfile("safari", &utls.HelloIOS_12_1,
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_3) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/12.0.3 Safari/605.1.15"))
+	RegisterProfile(appleProfile("ios", &utls.HelloIOS_12_1,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 12_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/12.0 Mobile/15E148 Safari/604.1"))
+
+	RegisterProfile(okhttpProfile())
+	RegisterProfile(curlProfile())
+}
+
+// chromeProfile returns a Chrome profile. A zero maxHeaderListSize leaves
+// the setting out, like Chrome did before it started sending it.
+func chromeProfile(name, version string, id *utls.ClientHelloID, maxHeaderListSize uint32) *Profile {
+	settings := []http2.Setting{
+		{ID: http2.SettingHeaderTableSize, Val: 65536},
+		{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
+		{ID: http2.SettingInitialWindowSize, Val: 6291456},
+	}
+	if maxHeaderListSize != 0 {
+		settings = append(settings, http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: maxHeaderListSize})
+	}
+
+	return &Profile{
+		Name:          name,
+		ClientHelloID: id,
+		H2Settings: &H2Settings{
+			ConnFlow:             15663105,
+			InitialWindowSize:    65535,
+			MaxConcurrentStreams: 1000,
+			Settings:             settings,
+			HeadersPriority:      &http2.PriorityParam{Exclusive: true, Weight: 255},
+			PseudoHeaderOrder:    []string{":method", ":authority", ":scheme", ":path"},
+		},
+		HeaderOrder: []string{
+			"Host",
+			"Connection",
+			"Upgrade-Insecure-Requests",
+			"User-Agent",
+			"Accept",
+			"Accept-Encoding",
+			"Accept-Language",
+			"Cookie",
+		},
+		Headers: http.Header{
+			"Connection":                {"keep-alive"},
+			"Upgrade-Insecure-Requests": {"1"},
+			"User-Agent":                {"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/" + version + " Safari/537.36"},
+			"Accept":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8"},
+			"Accept-Encoding":           {"gzip, deflate, br"},
+			"Accept-Language":           {"en-US,en;q=0.9"},
+		},
+	}
+}
+
+func firefoxProfile(name, version string, id *utls.ClientHelloID) *Profile {
+	return &Profile{
+		Name:          name,
+		ClientHelloID: id,
+		H2Settings: &H2Settings{
+			ConnFlow:             12517377,
+			InitialWindowSize:    65535,
+			MaxConcurrentStreams: 1000,
+			Settings: []http2.Setting{
+				{ID: http2.SettingHeaderTableSize, Val: 65536},
+				{ID: http2.SettingInitialWindowSize, Val: 131072},
+				{ID: http2.SettingMaxFrameSize, Val: 16384},
+			},
+			// the idle streams Firefox groups its requests under
+			PriorityFrames: []PriorityFrame{
+				{StreamID: 3, PriorityParam: http2.PriorityParam{Weight: 200}},
+				{StreamID: 5, PriorityParam: http2.PriorityParam{Weight: 100}},
+				{StreamID: 7, PriorityParam: http2.PriorityParam{Weight: 0}},
+				{StreamID: 9, PriorityParam: http2.PriorityParam{StreamDep: 7, Weight: 0}},
+				{StreamID: 11, PriorityParam: http2.PriorityParam{StreamDep: 3, Weight: 0}},
+				{StreamID: 13, PriorityParam: http2.PriorityParam{Weight: 240}},
+			},
+			HeadersPriority:   &http2.PriorityParam{StreamDep: 13, Weight: 41},
+			PseudoHeaderOrder: []string{":method", ":path", ":authority", ":scheme"},
+		},
+		HeaderOrder: []string{
+			"Host",
+			"User-Agent",
+			"Accept",
+			"Accept-Language",
+			"Accept-Encoding",
+			"Connection",
+			"Cookie",
+			"Upgrade-Insecure-Requests",
+		},
+		Headers: http.Header{
+			"User-Agent":                {"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:" + version + ") Gecko/20100101 Firefox/" + version},
+			"Accept":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+			"Accept-Language":           {"en-US,en;q=0.5"},
+			"Accept-Encoding":           {"gzip, deflate, br"},
+			"Connection":                {"keep-alive"},
+			"Upgrade-Insecure-Requests": {"1"},
+		},
+	}
+}
+
+func appleProfile(name string, id *utls.ClientHelloID, userAgent string) *Profile {
+	return &Profile{
+		Name:          name,
+		ClientHelloID: id,
+		H2Settings: &H2Settings{
+			ConnFlow:             10485760,
+			InitialWindowSize:    65535,
+			MaxConcurrentStreams: 100,
+			Settings: []http2.Setting{
+				{ID: http2.SettingInitialWindowSize, Val: 2097152},
+				{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+			},
+			PseudoHeaderOrder: []string{":method", ":scheme", ":path", ":authority"},
+		},
+		HeaderOrder: []string{
+			"Host",
+			"Accept",
+			"Cookie",
+			"User-Agent",
+			"Accept-Language",
+			"Accept-Encoding",
+			"Connection",
+		},
+		Headers: http.Header{
+			"Accept":          {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+			"User-Agent":      {userAgent},
+			"Accept-Language": {"en-us"},
+			"Accept-Encoding": {"br, gzip, deflate"},
+			"Connection":      {"keep-alive"},
+		},
+	}
+}
+
+// okhttpProfile is OkHttp 3 on Android 9, which uses the BoringSSL based
+// Conscrypt for TLS.
+func okhttpProfile() *Profile {
+	return &Profile{
+		Name: "okhttp",
+		ClientHelloSpec: func() *utls.ClientHelloSpec {
+			return &utls.ClientHelloSpec{
+				TLSVersMin: 0x0301,
+				TLSVersMax: 0x0304,
+				CipherSuites: []uint16{
+					0x1301, 0x1302, 0x1303,
+					0xc02b, 0xc02c, 0xcca9, 0xc02f, 0xc030, 0xcca8,
+					0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+				},
+				CompressionMethods: []uint8{0},
+				Extensions: []utls.TLSExtension{
+					&utls.SNIExtension{},
+					&utls.UtlsExtendedMasterSecretExtension{},
+					renegotiationInfoExtension(),
+					&utls.SupportedCurvesExtension{Curves: []utls.CurveID{utls.X25519, utls.CurveP256, utls.CurveP384}},
+					&utls.SupportedPointsExtension{SupportedPoints: []uint8{0}},
+					&utls.SessionTicketExtension{},
+					&utls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+					&utls.StatusRequestExtension{},
+					&utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []utls.SignatureScheme{
+						0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601, 0x0201,
+					}},
+					&utls.KeyShareExtension{KeyShares: []utls.KeyShare{{Group: utls.X25519}}},
+					&utls.PSKKeyExchangeModesExtension{Modes: []uint8{1}},
+					&utls.SupportedVersionsExtension{Versions: []uint16{0x0304, 0x0303, 0x0302, 0x0301}},
+					&utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle},
+				},
+			}
+		},
+		H2Settings: &H2Settings{
+			ConnFlow:             16711681,
+			InitialWindowSize:    65535,
+			MaxConcurrentStreams: 1000,
+			Settings: []http2.Setting{
+				{ID: http2.SettingInitialWindowSize, Val: 16777216},
+			},
+			PseudoHeaderOrder: []string{":method", ":path", ":authority", ":scheme"},
+		},
+		// OkHttp asks for gzip itself, so the transport does the same and
+		// decompresses the response
+		HeaderOrder: []string{
+			"Host",
+			"Connection",
+			"Accept-Encoding",
+			"Cookie",
+			"User-Agent",
+		},
+		Headers: http.Header{
+			"Connection": {"Keep-Alive"},
+			"User-Agent": {"okhttp/3.12.1"},
+		},
+	}
+}
+
+// curlProfile is curl 7.68 built against OpenSSL 1.1.1 and nghttp2. curl
+// also sends encrypt_then_mac (22) after ALPN, which uTLS has no extension
+// for, so its JA3 differs from curl's in that one place.
+func curlProfile() *Profile {
+	return &Profile{
+		Name: "curl",
+		ClientHelloSpec: func() *utls.ClientHelloSpec {
+			return &utls.ClientHelloSpec{
+				TLSVersMin: 0x0301,
+				TLSVersMax: 0x0304,
+				CipherSuites: []uint16{
+					0x1302, 0x1303, 0x1301,
+					0xc02c, 0xc030, 0x009f, 0xcca9, 0xcca8, 0xccaa, 0xc02b, 0xc02f, 0x009e,
+					0xc024, 0xc028, 0x006b, 0xc023, 0xc027, 0x0067, 0xc00a, 0xc014, 0x0039,
+					0xc009, 0xc013, 0x0033, 0x009d, 0x009c, 0x003d, 0x003c, 0x0035, 0x002f,
+					0x00ff,
+				},
+				CompressionMethods: []uint8{0},
+				Extensions: []utls.TLSExtension{
+					&utls.SNIExtension{},
+					&utls.SupportedPointsExtension{SupportedPoints: []uint8{0, 1, 2}},
+					&utls.SupportedCurvesExtension{Curves: []utls.CurveID{utls.X25519, utls.CurveP256, 30, utls.CurveP521, utls.CurveP384}},
+					&utls.SessionTicketExtension{},
+					&utls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+					&utls.UtlsExtendedMasterSecretExtension{},
+					&utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []utls.SignatureScheme{
+						0x0403, 0x0503, 0x0603, 0x0807, 0x0808, 0x0809, 0x080a, 0x080b,
+						0x0804, 0x0805, 0x0806, 0x0401, 0x0501, 0x0601,
+						0x0303, 0x0203, 0x0301, 0x0201, 0x0302, 0x0202, 0x0402, 0x0502, 0x0602,
+					}},
+					&utls.SupportedVersionsExtension{Versions: []uint16{0x0304, 0x0303, 0x0302, 0x0301}},
+					&utls.PSKKeyExchangeModesExtension{Modes: []uint8{1}},
+					&utls.KeyShareExtension{KeyShares: []utls.KeyShare{{Group: utls.X25519}}},
+					&utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle},
+				},
+			}
+		},
+		H2Settings: &H2Settings{
+			ConnFlow:             1073676289,
+			InitialWindowSize:    65535,
+			MaxConcurrentStreams: 100,
+			Settings: []http2.Setting{
+				{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+				{ID: http2.SettingInitialWindowSize, Val: 1073741824},
+				{ID: http2.SettingEnablePush, Val: 0},
+			},
+			PseudoHeaderOrder: []string{":method", ":path", ":scheme", ":authority"},
+		},
+		HeaderOrder: []string{
+			"Host",
+			"User-Agent",
+			"Accept",
+		},
+		Headers: http.Header{
+			"User-Agent": {"curl/7.68.0"},
+			"Accept":     {"*/*"},
+			// curl only asks for compression with --compressed
+			"Accept-Encoding": nil,
+		},
+	}
+}
@@ -79,24 +79,30 @@ func ProxyHTTP(network, addr string, auth *proxy.Auth, forward proxy.Dialer) (*h
 }
 
 type UTLSDialer struct {
-	config        *utls.Config
-	clientHelloID *utls.ClientHelloID
-	forward       proxy.Dialer
+	config          *utls.Config
+	clientHelloID   *utls.ClientHelloID
+	clientHelloSpec func() *utls.ClientHelloSpec
+	forward         proxy.Dialer
 }
 
 func (dialer *UTLSDialer) Dial(network, addr string) (net.Conn, error) {
-	return dialUTLS(network, addr, dialer.config, dialer.clientHelloID, dialer.forward)
+	return dialUTLS(network, addr, dialer.config, dialer.clientHelloID, dialer.clientHelloSpec, dialer.forward)
 }
 
 func ProxyHTTPS(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (*httpProxy, error) {
+	return proxyHTTPS(network, addr, auth, forward, cfg, clientHelloID, nil)
+}
+
+func proxyHTTPS(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cfg *utls.Config, clientHelloID *utls.ClientHelloID, clientHelloSpec func() *utls.ClientHelloSpec) (*httpProxy, error) {
 	return &httpProxy{
 		network: network,
 		addr:    addr,
 		auth:    auth,
 		forward: &UTLSDialer{
-			config:        cfg,
-			clientHelloID: clientHelloID,
-			forward:       forward,
+			config:          cfg,
+			clientHelloID:   clientHelloID,
+			clientHelloSpec: clientHelloSpec,
+			forward:         forward,
 		},
 	}, nil
 }
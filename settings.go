@@ -0,0 +1,194 @@
+package httpmod
+
+import (
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// H2Settings holds the values a client presents when it opens an HTTP/2
+// connection. Use DefaultH2Settings to start from the package level defaults
+// and attach the result to a transport with ConfigureH2Transport.
+type H2Settings struct {
+	// ConnFlow is the increment of the connection level WINDOW_UPDATE sent
+	// after the preface. Zero leaves the frame out, in which case the
+	// connection starts with the spec default window of InitialWindowSize
+	// and is only topped up once data arrives.
+	ConnFlow uint32
+
+	// StreamFlow is advertised as SETTINGS_INITIAL_WINDOW_SIZE.
+	StreamFlow uint32
+
+	// InitialWindowSize is the spec default window the connection starts
+	// out with, before any WINDOW_UPDATE.
+	InitialWindowSize uint32
+
+	MaxConcurrentStreams uint32
+	HeaderTableSize      uint32
+	MaxHeaderListSize    uint32
+	EnablePush           uint32
+	MaxFrameSize         uint32
+
+	// Settings, when non-nil, is written verbatim as the SETTINGS frame
+	// after the preface. Order is kept and unknown IDs, such as GREASE
+	// values, are sent as is. A setting left out of the list is at its spec
+	// default as far as the peer knows, so the connection uses that default
+	// as well rather than the field above.
+	Settings []http2.Setting
+
+	// PriorityFrames are written in order after the connection level
+	// WINDOW_UPDATE. Requests are sent on stream IDs above the highest one
+	// used here, which lets the frames build a tree of idle streams the
+	// way Firefox does.
+	PriorityFrames []PriorityFrame
+
+	// HeadersPriority, when non-nil, is sent on the HEADERS frame of every
+	// request that doesn't carry its own, see WithHeadersPriority.
+	HeadersPriority *http2.PriorityParam
+
+	// PseudoHeaderOrder is the order the pseudo headers of a request are
+	// written in, unless the request asks for its own, see
+	// WithPseudoHeaderOrder. Nil means
+	// :authority, :method, :path, :scheme.
+	PseudoHeaderOrder []string
+
+	// HeaderOrder is the order the headers of a request are written in,
+	// unless the request asks for its own, see WithHeaderOrder. It may hold
+	// UnlistedHeaders.
+	// Nil sends the request headers sorted by name.
+	HeaderOrder []string
+
+	// CombineCookies sends the Cookie header of a request as a single
+	// field. By default every cookie is sent as a field of its own, like
+	// Chrome does.
+	CombineCookies bool
+
+	// CookiePlacement says where the cookie fields go among the other
+	// headers.
+	CookiePlacement CookiePlacement
+
+	// HeaderEncodings sets the HPACK representation of header fields, keyed
+	// by lower case name, pseudo headers included. Fields that aren't
+	// listed use DefaultHeaderEncoding.
+	//
+	// Connections only swap hpack.Encoder for an encoder of this package
+	// when one of HeaderEncodings, DefaultHeaderEncoding, EncoderTableSize
+	// or TableSizeUpdate is set.
+	HeaderEncodings       map[string]HeaderEncoding
+	DefaultHeaderEncoding HeaderEncoding
+
+	// EncoderTableSize is the size of the dynamic table the HPACK encoder
+	// uses, as far as the SETTINGS_HEADER_TABLE_SIZE of the peer allows.
+	// Zero means 4096, the spec default.
+	EncoderTableSize uint32
+
+	// TableSizeUpdate starts the first header block with a dynamic table
+	// size update, even if the size is still the spec default.
+	TableSizeUpdate bool
+}
+
+// DefaultH2Settings returns the settings described by the package level
+// variables in http2frames.go. They are read at call time, so changing a
+// variable afterwards does not affect the returned value.
+func DefaultH2Settings() *H2Settings {
+	return &H2Settings{
+		ConnFlow:             TransportDefaultConnFlow,
+		StreamFlow:           TransportDefaultStreamFlow,
+		InitialWindowSize:    InitialWindowSize,
+		MaxConcurrentStreams: MaxConcurrentStreams,
+		HeaderTableSize:      InitialHeaderTableSize,
+		MaxHeaderListSize:    MaxHeaderListSize,
+		EnablePush:           SettingEnablePush,
+		MaxFrameSize:         MaxFrameSize,
+		HeaderOrder:          DefaultHeaderOrder,
+	}
+}
+
+// initialSettings returns the SETTINGS entries to send after the preface.
+func (s *H2Settings) initialSettings() []http2.Setting {
+	if s.Settings != nil {
+		return s.Settings
+	}
+
+	return []http2.Setting{
+		{ID: http2.SettingEnablePush, Val: s.EnablePush},
+		{ID: http2.SettingInitialWindowSize, Val: s.StreamFlow},
+		{ID: http2.SettingMaxConcurrentStreams, Val: s.MaxConcurrentStreams},
+		{ID: http2.SettingHeaderTableSize, Val: s.HeaderTableSize},
+		{ID: http2.SettingMaxFrameSize, Val: s.MaxFrameSize},
+		{ID: http2.SettingMaxHeaderListSize, Val: s.MaxHeaderListSize},
+	}
+}
+
+// settingValue returns the value advertised for id, or def if the setting
+// is not sent. The last entry wins if id is listed more than once, like it
+// does on the receiving side.
+func (s *H2Settings) settingValue(id http2.SettingID, def uint32) uint32 {
+	val := def
+	for _, setting := range s.initialSettings() {
+		if setting.ID == id {
+			val = setting.Val
+		}
+	}
+	return val
+}
+
+var h2SettingsRegistry = struct {
+	sync.RWMutex
+	m map[*http2.Transport]*H2Settings
+}{m: make(map[*http2.Transport]*H2Settings)}
+
+// ConfigureH2Transport opts t in to the HTTP/2 patches installed by Apply.
+// Every connection t opens afterwards presents settings, start from
+// DefaultH2Settings for the package level variables. Passing nil settings
+// detaches t again, connections it opens afterwards behave like the stdlib
+// ones. The registry holds on to t until it is detached.
+func ConfigureH2Transport(t *http2.Transport, settings *H2Settings) {
+	h2SettingsRegistry.Lock()
+	defer h2SettingsRegistry.Unlock()
+
+	if settings == nil {
+		delete(h2SettingsRegistry.m, t)
+		return
+	}
+	h2SettingsRegistry.m[t] = settings
+}
+
+// h2SettingsFor returns the settings t was configured with, or nil if it
+// wasn't.
+func h2SettingsFor(t *http2.Transport) *H2Settings {
+	h2SettingsRegistry.RLock()
+	defer h2SettingsRegistry.RUnlock()
+
+	return h2SettingsRegistry.m[t]
+}
+
+// customEncoding reports whether s asks for an HPACK encoding that
+// hpack.Encoder doesn't produce.
+func (s *H2Settings) customEncoding() bool {
+	return len(s.HeaderEncodings) != 0 || s.DefaultHeaderEncoding != (HeaderEncoding{}) || s.EncoderTableSize != 0 || s.TableSizeUpdate
+}
+
+// clone returns a copy of s that shares nothing with it.
+func (s *H2Settings) clone() *H2Settings {
+	clone := *s
+	if s.Settings != nil {
+		clone.Settings = append([]http2.Setting(nil), s.Settings...)
+	}
+	clone.PriorityFrames = append([]PriorityFrame(nil), s.PriorityFrames...)
+	if s.HeadersPriority != nil {
+		param := *s.HeadersPriority
+		clone.HeadersPriority = &param
+	}
+	clone.PseudoHeaderOrder = append([]string(nil), s.PseudoHeaderOrder...)
+	if s.HeaderOrder != nil {
+		clone.HeaderOrder = append([]string(nil), s.HeaderOrder...)
+	}
+	if s.HeaderEncodings != nil {
+		clone.HeaderEncodings = make(map[string]HeaderEncoding, len(s.HeaderEncodings))
+		for name, encoding := range s.HeaderEncodings {
+			clone.HeaderEncodings[name] = encoding
+		}
+	}
+	return &clone
+}
@@ -1,13 +1,17 @@
 package httpmod
 
 import (
+	"container/list"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	utls "gitlab.com/yawning/utls.git"
 	"golang.org/x/net/http2"
@@ -56,43 +60,132 @@ func addrForDial(url *url.URL) (string, error) {
 }
 
 // Analogous to tls.Dial. Connect to the given address and initiate a TLS
-// handshake using the given ClientHelloID, returning the resulting connection.
-func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, forward proxy.Dialer) (*utls.UConn, error) {
+// handshake using the given ClientHelloID, or the ClientHelloSpec returned by
+// clientHelloSpec if it is non-nil, returning the resulting connection.
+func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, clientHelloSpec func() *utls.ClientHelloSpec, forward proxy.Dialer) (*utls.UConn, error) {
 	conn, err := forward.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	uconn := utls.UClient(conn, cfg, *clientHelloID)
 	if cfg == nil || cfg.ServerName == "" {
 		serverName, _, err := net.SplitHostPort(addr)
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
-		uconn.SetSNI(serverName)
+		// uTLS writes the SNI to the config, which is shared between
+		// connections to different hosts
+		if cfg == nil {
+			cfg = &utls.Config{}
+		} else {
+			cfg = cfg.Clone()
+		}
+		cfg.ServerName = serverName
+	}
+
+	var uconn *utls.UConn
+	if clientHelloSpec != nil {
+		spec := clientHelloSpec()
+		if spec == nil {
+			conn.Close()
+			return nil, fmt.Errorf("nil ClientHelloSpec")
+		}
+		uconn = utls.UClient(conn, cfg, utls.HelloCustom)
+		if err := uconn.ApplyPreset(spec); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		uconn = utls.UClient(conn, cfg, *clientHelloID)
+	}
+	// bound the handshake like http.DefaultTransport does
+	if d := httpRoundTripper.TLSHandshakeTimeout; d != 0 {
+		conn.SetDeadline(time.Now().Add(d))
 	}
 	err = uconn.Handshake()
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 	return uconn, nil
 }
 
-// A http.RoundTripper that uses uTLS (with a specified Client Hello ID) to make
-// TLS connections.
+var (
+	renegotiationInfoOnce sync.Once
+	renegotiationInfo     utls.RenegotiationInfoExtension
+)
+
+// renegotiationInfoExtension returns a renegotiation_info extension that
+// offers to renegotiate once, like the one in the uTLS presets. The field
+// that makes uTLS send the extension is unexported, so it is copied from a
+// preset.
+func renegotiationInfoExtension() *utls.RenegotiationInfoExtension {
+	renegotiationInfoOnce.Do(func() {
+		uconn := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_72)
+		if err := uconn.BuildHandshakeState(); err != nil {
+			panic(err)
+		}
+		for _, ext := range uconn.Extensions {
+			if e, ok := ext.(*utls.RenegotiationInfoExtension); ok {
+				renegotiationInfo = *e
+			}
+		}
+	})
+	ext := renegotiationInfo
+	return &ext
+}
+
+// A http.RoundTripper that uses uTLS (with a specified Client Hello ID or
+// ClientHelloSpec) to make TLS connections.
 //
-// Can only be reused among servers which negotiate the same ALPN.
+// Every origin gets an H1Transport or H2Transport of its own, picked by the
+// ALPN it negotiates on the first connection. The transports of the origins
+// used least recently are dropped once there are more than
+// DefaultMaxOrigins, see SetMaxOrigins.
 type UTLSRoundTripper struct {
 	sync.Mutex
 
-	clientHelloID *utls.ClientHelloID
-	config        *utls.Config
-	proxyDialer   proxy.Dialer
-	rt            http.RoundTripper
+	clientHelloID   *utls.ClientHelloID
+	clientHelloSpec func() *utls.ClientHelloSpec
+	config          *utls.Config
+	proxyDialer     proxy.Dialer
+	h2Settings      *H2Settings
+	h1HeaderOrder   []string
+
+	// inner transports keyed by origin, most recently used at the front
+	// of lru
+	origins    map[string]*originTransport
+	lru        *list.List
+	maxOrigins int
 
 	// Transport for HTTP requests, which don't use uTLS.
 	httpRT *http.Transport
 }
 
+// DefaultMaxOrigins is the number of origins a UTLSRoundTripper keeps a
+// transport for, unless SetMaxOrigins says otherwise.
+const DefaultMaxOrigins = 64
+
+// originTransport is the transport of one origin. rt and err are set once
+// ready is closed.
+type originTransport struct {
+	key   string
+	elem  *list.Element
+	ready chan struct{}
+	rt    http.RoundTripper
+	err   error
+}
+
+// SetH2Settings sets the HTTP/2 settings used for connections that negotiate
+// h2. It must be called before the first request is made.
+func (rt *UTLSRoundTripper) SetH2Settings(settings *H2Settings) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	rt.h2Settings = settings
+}
+
 func (rt *UTLSRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	switch req.URL.Scheme {
 	case "http":
@@ -104,23 +197,151 @@ func (rt *UTLSRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 		return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
 	}
 
+	origin, err := rt.originTransport(req)
+	if err != nil {
+		return nil, err
+	}
+	// Forward the request to the internal H1Transport or H2Transport.
+	return origin.RoundTrip(req)
+}
+
+// SetMaxOrigins sets the number of origins transports are kept for. Zero
+// means DefaultMaxOrigins.
+func (rt *UTLSRoundTripper) SetMaxOrigins(n int) {
 	rt.Lock()
 	defer rt.Unlock()
 
-	if rt.rt == nil {
-		// On the first call, make an http.Transport or http2.Transport
-		// as appropriate.
-		var err error
-		rt.rt, err = makeRoundTripper(req.URL, rt.clientHelloID, rt.config, rt.proxyDialer)
-		if err != nil {
-			return nil, err
+	rt.maxOrigins = n
+	rt.evictOrigins()
+}
+
+// CloseIdleConnections closes the idle connections of every origin.
+func (rt *UTLSRoundTripper) CloseIdleConnections() {
+	rt.Lock()
+	var transports []http.RoundTripper
+	for _, o := range rt.origins {
+		if o.isReady() {
+			transports = append(transports, o.rt)
 		}
 	}
-	// Forward the request to the internal http.Transport or http2.Transport.
-	return rt.rt.RoundTrip(req)
+	rt.Unlock()
+
+	for _, t := range transports {
+		closeIdleConnections(t)
+	}
+	rt.httpRT.CloseIdleConnections()
 }
 
-func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (proxy.Dialer, error) {
+// originTransport returns the transport for the origin of req, making one if
+// there is none yet. Concurrent requests to a new origin wait for the first
+// one to find out its ALPN.
+func (rt *UTLSRoundTripper) originTransport(req *http.Request) (http.RoundTripper, error) {
+	addr, err := addrForDial(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	key := req.URL.Scheme + "://" + addr
+
+	rt.Lock()
+	if rt.origins == nil {
+		rt.origins = make(map[string]*originTransport)
+		rt.lru = list.New()
+	}
+	o, ok := rt.origins[key]
+	if ok {
+		rt.lru.MoveToFront(o.elem)
+	} else {
+		o = &originTransport{key: key, ready: make(chan struct{})}
+		o.elem = rt.lru.PushFront(o)
+		rt.origins[key] = o
+		rt.evictOrigins()
+	}
+	clientHelloID, clientHelloSpec, cfg, proxyDialer := rt.clientHelloID, rt.clientHelloSpec, rt.config, rt.proxyDialer
+	h2Settings, h1HeaderOrder := rt.h2Settings, rt.h1HeaderOrder
+	rt.Unlock()
+
+	if !ok {
+		// The first request to an origin makes an H1Transport or
+		// H2Transport as appropriate.
+		o.rt, o.err = makeRoundTripper(req.URL, clientHelloID, clientHelloSpec, cfg, proxyDialer, h2Settings, h1HeaderOrder)
+		if o.err != nil {
+			// let the next request try again
+			rt.Lock()
+			rt.removeOrigin(o)
+			rt.Unlock()
+		}
+		close(o.ready)
+	}
+
+	select {
+	case <-o.ready:
+		return o.rt, o.err
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+// evictOrigins drops the least recently used origins while there are too
+// many. Origins still looking for their ALPN are skipped, requests are
+// waiting on them. rt must be locked.
+func (rt *UTLSRoundTripper) evictOrigins() {
+	if rt.lru == nil {
+		return
+	}
+	limit := rt.maxOrigins
+	if limit <= 0 {
+		limit = DefaultMaxOrigins
+	}
+
+	for e := rt.lru.Back(); e != nil && rt.lru.Len() > limit; {
+		o := e.Value.(*originTransport)
+		e = e.Prev()
+		if !o.isReady() {
+			continue
+		}
+		rt.removeOrigin(o)
+		// requests in flight finish on their own, their connections
+		// are closed afterwards
+		go closeWhenIdle(o.rt)
+	}
+}
+
+// removeOrigin drops o from the cache, if it is still there. rt must be
+// locked.
+func (rt *UTLSRoundTripper) removeOrigin(o *originTransport) {
+	if rt.origins[o.key] != o {
+		return
+	}
+	delete(rt.origins, o.key)
+	rt.lru.Remove(o.elem)
+}
+
+func (o *originTransport) isReady() bool {
+	select {
+	case <-o.ready:
+		return o.err == nil
+	default:
+		return false
+	}
+}
+
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// closeWhenIdle closes the connections of the transport of an origin that
+// was dropped, the idle ones right away and the others once they are done.
+func closeWhenIdle(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ closeWhenIdle() }); ok {
+		c.closeWhenIdle()
+		return
+	}
+	closeIdleConnections(rt)
+}
+
+func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.ClientHelloID, clientHelloSpec func() *utls.ClientHelloSpec) (proxy.Dialer, error) {
 	var proxyDialer proxy.Dialer = proxy.Direct
 	if proxyURL == nil {
 		return proxyDialer, nil
@@ -155,7 +376,7 @@ func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.Cl
 		if cfg != nil {
 			cfgClone = cfg.Clone()
 		}
-		proxyDialer, err = ProxyHTTPS("tcp", proxyAddr, auth, proxyDialer, cfgClone, clientHelloID)
+		proxyDialer, err = proxyHTTPS("tcp", proxyAddr, auth, proxyDialer, cfgClone, clientHelloID, clientHelloSpec)
 	default:
 		return nil, fmt.Errorf("cannot use proxy scheme %q with uTLS", proxyURL.Scheme)
 	}
@@ -163,7 +384,7 @@ func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.Cl
 	return proxyDialer, err
 }
 
-func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyDialer proxy.Dialer) (http.RoundTripper, error) {
+func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, clientHelloSpec func() *utls.ClientHelloSpec, cfg *utls.Config, proxyDialer proxy.Dialer, h2Settings *H2Settings, h1HeaderOrder []string) (http.RoundTripper, error) {
 	addr, err := addrForDial(url)
 	if err != nil {
 		return nil, err
@@ -173,7 +394,7 @@ func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls
 	// initiate a TLS handshake using the given ClientHelloID. Return the
 	// resulting connection.
 	dial := func(network, addr string) (*utls.UConn, error) {
-		return dialUTLS(network, addr, cfg, clientHelloID, proxyDialer)
+		return dialUTLS(network, addr, cfg, clientHelloID, clientHelloSpec, proxyDialer)
 	}
 
 	bootstrapConn, err := dial("tcp", addr)
@@ -187,7 +408,7 @@ func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls
 	// Protects bootstrapConn.
 	var lock sync.Mutex
 	// This is the callback for future dials done by the internal
-	// http.Transport or http2.Transport.
+	// H1Transport or H2Transport.
 	dialTLS := func(network, addr string) (net.Conn, error) {
 		lock.Lock()
 		defer lock.Unlock()
@@ -212,28 +433,26 @@ func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls
 		return uconn, nil
 	}
 
-	// Construct an http.Transport or http2.Transport depending on ALPN.
+	// Construct an H1Transport or H2Transport depending on ALPN.
 	switch protocol {
 	case http2.NextProtoTLS:
-		// Unfortunately http2.Transport does not expose the same
-		// configuration options as http.Transport with regard to
-		// timeouts, etc., so we are at the mercy of the defaults.
-		// https://github.com/golang/go/issues/16581
-		return &http2.Transport{
-			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
-				// Ignore the *tls.Config parameter; use our
-				// static cfg instead.
-				return dialTLS(network, addr)
-			},
+		// Our own HTTP/2 transport presents h2Settings without
+		// needing Apply.
+		return &H2Transport{
+			DialTLS:  dialTLS,
+			Settings: h2Settings,
 		}, nil
 	default:
-		// With http.Transport, copy important default fields from
-		// http.DefaultTransport, such as TLSHandshakeTimeout and
-		// IdleConnTimeout.
-		tr := &http.Transport{}
-		copyPublicFields(tr, httpRoundTripper)
-		tr.DialTLS = dialTLS
-		return tr, nil
+		// Our own HTTP/1.1 transport keeps the header order and casing
+		// without needing Apply. Take the timeouts of
+		// http.DefaultTransport, the TLS handshake one is applied by
+		// dialUTLS.
+		return &H1Transport{
+			DialTLS:               dialTLS,
+			HeaderOrder:           h1HeaderOrder,
+			IdleConnTimeout:       httpRoundTripper.IdleConnTimeout,
+			ExpectContinueTimeout: httpRoundTripper.ExpectContinueTimeout,
+		}, nil
 	}
 }
 
@@ -249,16 +468,91 @@ var clientHelloIDMap = map[string]*utls.ClientHelloID{
 	"hellofirefox_55":       &utls.HelloFirefox_55,
 	"hellofirefox_56":       &utls.HelloFirefox_56,
 	"hellofirefox_63":       &utls.HelloFirefox_63,
+	"hellofirefox_65":       &utls.HelloFirefox_65,
 	"hellochrome_auto":      &utls.HelloChrome_Auto,
 	"hellochrome_58":        &utls.HelloChrome_58,
 	"hellochrome_62":        &utls.HelloChrome_62,
 	"hellochrome_70":        &utls.HelloChrome_70,
+	"hellochrome_72":        &utls.HelloChrome_72,
 	"helloios_auto":         &utls.HelloIOS_Auto,
 	"helloios_11_1":         &utls.HelloIOS_11_1,
+	"helloios_12_1":         &utls.HelloIOS_12_1,
 }
 
+// ClientHelloIDByName returns the ClientHelloID called name, e.g.
+// "hellochrome_auto". Names are case-insensitive. "none" and "hellogolang"
+// return a nil ID, they stand for the ClientHello of crypto/tls.
+func ClientHelloIDByName(name string) (*utls.ClientHelloID, error) {
+	id, ok := clientHelloIDMap[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("no uTLS Client Hello ID named %q", name)
+	}
+	return id, nil
+}
+
+// ClientHelloIDNames returns the names ClientHelloIDByName knows, sorted.
+func ClientHelloIDNames() []string {
+	names := make([]string, 0, len(clientHelloIDMap))
+	for name := range clientHelloIDMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewUTLSRoundTripper returns a RoundTripper that makes TLS connections with
+// the ClientHello of clientHelloID. A nil clientHelloID disables uTLS, the
+// RoundTripper is then an http.Transport using crypto/tls.
 func NewUTLSRoundTripper(clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyURL *url.URL) (http.RoundTripper, error) {
-	proxyDialer, err := makeProxyDialer(proxyURL, cfg, clientHelloID)
+	if clientHelloID == nil {
+		return makeStdlibRoundTripper(cfg, proxyURL), nil
+	}
+	return newUTLSRoundTripper(clientHelloID, nil, cfg, proxyURL)
+}
+
+// NewUTLSRoundTripperWithSpec returns a RoundTripper that makes TLS
+// connections with the ClientHello clientHelloSpec returns, for ClientHellos
+// uTLS has no ClientHelloID for. clientHelloSpec is called for every
+// connection and must return a new spec each time, uTLS keeps state in the
+// extensions of a spec. The ALPN extension of the spec decides between
+// HTTP/2 and HTTP/1.1.
+func NewUTLSRoundTripperWithSpec(clientHelloSpec func() *utls.ClientHelloSpec, cfg *utls.Config, proxyURL *url.URL) (http.RoundTripper, error) {
+	if clientHelloSpec == nil {
+		return nil, fmt.Errorf("nil ClientHelloSpec")
+	}
+	return newUTLSRoundTripper(nil, clientHelloSpec, cfg, proxyURL)
+}
+
+// NewUTLSRoundTripperByName is NewUTLSRoundTripper with the ClientHelloID
+// called name, see ClientHelloIDByName.
+func NewUTLSRoundTripperByName(name string, cfg *utls.Config, proxyURL *url.URL) (http.RoundTripper, error) {
+	clientHelloID, err := ClientHelloIDByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewUTLSRoundTripper(clientHelloID, cfg, proxyURL)
+}
+
+// makeStdlibRoundTripper returns an http.Transport for when uTLS is disabled.
+// It takes the settings of cfg that crypto/tls has as well.
+func makeStdlibRoundTripper(cfg *utls.Config, proxyURL *url.URL) *http.Transport {
+	rt := &http.Transport{}
+	copyPublicFields(rt, httpRoundTripper)
+	rt.Proxy = http.ProxyURL(proxyURL)
+
+	if cfg != nil {
+		rt.TLSClientConfig = &tls.Config{
+			ServerName:         cfg.ServerName,
+			RootCAs:            cfg.RootCAs,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+			KeyLogWriter:       cfg.KeyLogWriter,
+		}
+	}
+	return rt
+}
+
+func newUTLSRoundTripper(clientHelloID *utls.ClientHelloID, clientHelloSpec func() *utls.ClientHelloSpec, cfg *utls.Config, proxyURL *url.URL) (*UTLSRoundTripper, error) {
+	proxyDialer, err := makeProxyDialer(proxyURL, cfg, clientHelloID, clientHelloSpec)
 	if err != nil {
 		return nil, err
 	}
@@ -270,10 +564,10 @@ func NewUTLSRoundTripper(clientHelloID *utls.ClientHelloID, cfg *utls.Config, pr
 	httpRT.Proxy = http.ProxyURL(proxyURL)
 
 	return &UTLSRoundTripper{
-		clientHelloID: clientHelloID,
-		config:        cfg,
-		proxyDialer:   proxyDialer,
-		// rt will be set in the first call to RoundTrip.
-		httpRT: httpRT,
+		clientHelloID:   clientHelloID,
+		clientHelloSpec: clientHelloSpec,
+		config:          cfg,
+		proxyDialer:     proxyDialer,
+		httpRT:          httpRT,
 	}, nil
 }